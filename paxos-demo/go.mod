@@ -3,3 +3,5 @@ module main
 go 1.18
 
 require github.com/mgbelisle/science v0.0.0-20221013234543-acd203d8640b
+
+replace github.com/mgbelisle/science => ../
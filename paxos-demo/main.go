@@ -56,16 +56,16 @@ func main() {
 		"Franz Krieger":   "Berlin",
 	}
 	for agent := range agents {
-		node := network.AddNode(agent, make(<-chan []byte), paxos.MemoryStorage())
+		node := network.AddNode(agent, paxos.MemoryStorage())
 		nodes[agent] = node
 	}
 
-	// Each agent tries to write key 0 simultaneously
+	// Each agent tries to write the meetup key simultaneously
 	for agent, proposal := range agents {
 		wg.Add(1)
 		go func(agent, proposal string) {
 			defer wg.Add(-1)
-			value, err := nodes[agent].Write(context.Background(), 0, []byte(proposal))
+			value, err := nodes[agent].Write(context.Background(), "meetup", []byte(proposal))
 			if err != nil {
 				log.Printf("%s error: %v", agent, err)
 				return
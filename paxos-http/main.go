@@ -10,12 +10,50 @@
 //
 // Client side
 //
-//     $ curl -X POST -d "People are crazy" 'http://188.226.130.53:10000/3'
+//     $ curl -X POST -d "People are crazy" 'http://188.226.130.53:10000/kv/quotes/3'
 //     People are crazy
-//     $ curl 'http://188.226.130.53:10001/3'
+//     $ curl 'http://188.226.130.53:10001/kv/quotes/3'
 //     People are crazy
-//     $ curl -X POST -d "Beer is good" 'http://188.226.130.53:10002/3' // 3 has already been written
+//     $ curl -X POST -d "Beer is good" 'http://188.226.130.53:10002/kv/quotes/3' // Already written
 //     People are crazy
+//
+// Write many keys at once with a JSON object of keys to values, which answers with what each key holds
+//
+//     $ curl -X POST -d '{"quotes/4": "Beer is good", "quotes/5": "Wine is fine"}' 'http://188.226.130.53:10000/batch'
+//     {"quotes/4":{"value":"Beer is good"},"quotes/5":{"value":"Wine is fine"}}
+//
+// List the keys in a range that have values, in byte order, with to left out and limit optional. Keys
+// that could not be read, such as ones with a write in progress, are listed in an X-Skipped-Keys header.
+//
+//     $ curl 'http://188.226.130.53:10000/scan?from=quotes/3&to=quotes/5'
+//     [{"key":"quotes/3","value":"People are crazy"},{"key":"quotes/4","value":"Beer is good"}]
+//
+// Wait up to a minute for a key to be decided
+//
+//     $ curl 'http://188.226.130.53:10000/watch/quotes/6' &
+//     $ curl -X POST -d "Beer is good" 'http://188.226.130.53:10001/kv/quotes/6'
+//     Beer is good
+//     Beer is good
+//
+// Replace a dead host by starting a new one with --join, then changing members one at a time
+//
+//     $ go run main.go --addr 188.226.130.53:10005 --nodes '188.226.130.53:10000 188.226.130.53:10001 188.226.130.53:10002 188.226.130.53:10003' --key rsa-private-key.pem --join &
+//     $ curl -X POST 'http://188.226.130.53:10000/members/188.226.130.53:10005'
+//     $ curl -X DELETE 'http://188.226.130.53:10000/members/188.226.130.53:10004'
+//
+// Add a read replica that never votes by starting it with --learner, and listing it in --learners
+// on the members
+//
+//     $ go run main.go --addr 188.226.130.53:10006 --nodes '188.226.130.53:10000 188.226.130.53:10001 188.226.130.53:10002 188.226.130.53:10003 188.226.130.53:10004' --key rsa-private-key.pem --learner &
+//
+// Keep only hashes of values on some members by listing them in --witnesses on every node
+//
+//     $ go run main.go --addr 188.226.130.53:10000 --nodes '188.226.130.53:10001 188.226.130.53:10002' --key rsa-private-key.pem --witnesses 188.226.130.53:10002 &
+//
+// Send messages between nodes over long lived TCP connections rather than HTTP by giving every node
+// the same --tcp-offset, here listening on 11000 through 11004
+//
+//     $ go run main.go --addr 188.226.130.53:10000 --nodes '188.226.130.53:10001 188.226.130.53:10002 188.226.130.53:10003 188.226.130.53:10004' --key rsa-private-key.pem --tcp-offset 1000 &
 
 package main
 
@@ -27,20 +65,23 @@ import (
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"science/paxos"
+	"github.com/mgbelisle/science/paxos"
 )
 
 const usagePrefix = `Runs a key value store
@@ -51,10 +92,25 @@ OPTIONS:
 `
 
 var (
-	addrFlag    = flag.String("addr", "localhost:10000", "Address to listen and serve")
-	nodesFlag   = flag.String("nodes", "localhost:10001 localhost:10002", "Remote nodes")
-	keyFlag     = flag.String("key", "", "Path to RSA private key")
-	profileFlag = flag.Bool("profile", false, "Profile memory and GC")
+	addrFlag     = flag.String("addr", "localhost:10000", "Address to listen and serve")
+	nodesFlag    = flag.String("nodes", "localhost:10001 localhost:10002", "Remote nodes")
+	keyFlag      = flag.String("key", "", "Path to RSA private key")
+	profileFlag  = flag.Bool("profile", false, "Profile memory and GC")
+	multiFlag    = flag.Bool("multi-paxos", false, "Elect a stable leader so writes skip phase 1, must match on every node")
+	leaseFlag    = flag.Bool("lease-reads", false, "Let the leader answer reads itself, needs --multi-paxos and must match on every node")
+	fastFlag     = flag.Bool("fast-paxos", false, "Send writes straight to every node so uncontested ones take one round trip, must match on every node")
+	phase1Flag   = flag.Int("phase1-quorum", 0, "Weight phase 1 needs to hear from, zero for more than half")
+	phase2Flag   = flag.Int("phase2-quorum", 0, "Weight phase 2 needs to hear from, zero for more than half")
+	weightsFlag  = flag.String("weights", "", "Votes that do not count as 1, such as 'localhost:10001=2', must match on every node")
+	learnerFlag  = flag.Bool("learner", false, "Serve reads without voting, --nodes lists the members")
+	learnersFlag = flag.String("learners", "", "Remote learners to send final values to")
+	witnessFlag  = flag.String("witnesses", "", "Members that keep hashes rather than values, which may include this node, must match on every node")
+	syncFlag     = flag.Duration("anti-entropy", time.Minute, "How often to catch up on final values with a random member, zero to turn it off")
+	resendFlag   = flag.Duration("resend", time.Second, "How long to wait on a reply before sending a request again, zero to never send again")
+	codecFlag    = flag.String("codec", "json", "How nodes encode messages to each other, json or binary, should match on every node")
+	tcpFlag      = flag.Int("tcp-offset", 0, "Send messages between nodes over TCP on each address's port plus this rather than over HTTP, must match on every node")
+	storageFlag  = flag.String("storage", "disk", "How this node keeps its state, disk for a file per key or log for a write-ahead log")
+	joinFlag     = flag.Bool("join", false, "Join a running cluster, this node is not a member until added with POST /members/ADDR")
 )
 
 func main() {
@@ -102,38 +158,145 @@ func main() {
 	if false {
 		network.SetLoggers(stdout, stderr)
 	}
-	for _, node := range strings.Fields(*nodesFlag) {
-		channel := make(chan []byte)
-		network.AddRemoteNode(node, channel)
-		go func(node string, channel <-chan []byte) {
-			for data := range channel {
-				// Some simple auth
-				hash := sha512.Sum512(data)
-				signatureBytes, _ := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA512, hash[:])
-				signature := base64.RawURLEncoding.EncodeToString(signatureBytes)
-
+	network.SetMultiPaxos(*multiFlag)
+	network.SetLeaseReads(*leaseFlag)
+	network.SetFastPaxos(*fastFlag)
+	network.SetAntiEntropy(*syncFlag)
+	network.SetResendTimeout(*resendFlag)
+	switch *codecFlag {
+	case "json":
+	case "binary":
+		network.SetCodec(paxos.BinaryCodec())
+	default:
+		log.Fatalf("Codec %q is not json or binary", *codecFlag)
+	}
+	// Some simple auth
+	sign := func(data []byte) []byte {
+		hash := sha512.Sum512(data)
+		signature, _ := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA512, hash[:])
+		return signature
+	}
+	verify := func(data, signature []byte) error {
+		hash := sha512.Sum512(data)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA512, hash[:], signature)
+	}
+	receiveMutex := sync.Mutex{}
+	receive := (func(ctx context.Context, msg []byte) error)(nil) // Hands a message from POST /paxos to the local node
+	if *tcpFlag == 0 {
+		network.SetTransport(paxos.FuncTransport(&paxos.TransportFuncs{
+			Send: func(ctx context.Context, node string, data []byte) error {
 				addr := fmt.Sprintf("http://%s/paxos", node)
-				req, err := http.NewRequest("POST", addr, bytes.NewBuffer(data))
+				req, err := http.NewRequestWithContext(ctx, "POST", addr, bytes.NewBuffer(data))
 				if err != nil {
-					stderr.Print(err)
-					continue
+					return err
 				}
-				req.Header.Set(authorizationHeader, signature)
+				req.Header.Set(authorizationHeader, base64.RawURLEncoding.EncodeToString(sign(data)))
 				resp, err := http.DefaultClient.Do(req)
 				if err != nil {
-					stderr.Print(err)
-					continue
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					body, _ := ioutil.ReadAll(resp.Body)
+					return fmt.Errorf("%s answered %s: %s", node, resp.Status, bytes.TrimSpace(body))
 				}
-				resp.Body.Close()
+				return nil
+			},
+			Listen: func(node string, receive2 func(ctx context.Context, msg []byte) error) {
+				receiveMutex.Lock()
+				defer receiveMutex.Unlock()
+				receive = receive2
+			},
+		}))
+	} else {
+		// Each message goes over TCP with its signature in front, which is as long as the key
+		shift := func(addr string) string {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return addr
+			}
+			portInt, err := strconv.Atoi(port)
+			if err != nil {
+				return addr
 			}
-		}(node, channel)
+			return net.JoinHostPort(host, strconv.Itoa(portInt+*tcpFlag))
+		}
+		transport, err := paxos.TCPTransport(shift(*addrFlag), shift)
+		if err != nil {
+			log.Fatal(err)
+		}
+		size := privateKey.Size()
+		network.SetTransport(paxos.FuncTransport(&paxos.TransportFuncs{
+			Send: func(ctx context.Context, node string, data []byte) error {
+				return transport.Send(ctx, node, append(sign(data), data...))
+			},
+			Listen: func(node string, receive2 func(ctx context.Context, msg []byte) error) {
+				if receive2 == nil {
+					transport.Listen(node, nil)
+					return
+				}
+				transport.Listen(node, func(ctx context.Context, msg []byte) error {
+					if len(msg) < size {
+						return fmt.Errorf("Message is too short to be signed")
+					}
+					if err := verify(msg[size:], msg[:size]); err != nil {
+						stderr.Print(err)
+						return err
+					}
+					return receive2(ctx, msg[size:])
+				})
+			},
+			Close: transport.Close,
+		}))
+	}
+	for _, node := range strings.Fields(*nodesFlag) {
+		network.AddRemoteNode(node)
+	}
+	for _, learner := range strings.Fields(*learnersFlag) {
+		network.AddRemoteLearner(learner)
+	}
+	for _, witness := range strings.Fields(*witnessFlag) {
+		network.SetWitness(witness)
 	}
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
 	}
-	channel := make(chan []byte)
-	node := network.AddNode(*addrFlag, channel, paxos.DiskStorage(path.Join(cwd, *addrFlag)))
+	addNode := network.AddNode
+	if *joinFlag {
+		addNode = network.AddNewNode
+	}
+	if *learnerFlag {
+		addNode = network.AddLearner
+	}
+	storage := paxos.Storage(nil)
+	switch *storageFlag {
+	case "disk":
+		storage = paxos.DiskStorage(path.Join(cwd, *addrFlag))
+	case "log":
+		if storage, err = paxos.LogStorage(path.Join(cwd, *addrFlag)); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Storage %q is not disk or log", *storageFlag)
+	}
+	node := addNode(*addrFlag, storage)
+	for _, field := range strings.Fields(*weightsFlag) {
+		i := strings.LastIndex(field, "=")
+		if i < 0 {
+			log.Fatalf("Weight %q is not ADDR=WEIGHT", field)
+		}
+		weight, err := strconv.Atoi(field[i+1:])
+		if err != nil {
+			log.Fatalf("Weight %q is not ADDR=WEIGHT", field)
+		}
+		if err := network.SetWeight(field[:i], weight); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := network.SetQuorums(*phase1Flag, *phase2Flag); err != nil {
+		log.Fatal(err)
+	}
 
 	if *profileFlag {
 		go func() {
@@ -159,35 +322,171 @@ func main() {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			hash := sha512.Sum512(msg)
 			signature, err := base64.RawURLEncoding.DecodeString(r.Header.Get(authorizationHeader))
 			if err != nil {
 				stderr.Print(err)
 				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
-			if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA512, hash[:], signature); err != nil {
+			if err := verify(msg, signature); err != nil {
 				stderr.Print(err)
 				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
-			go func() {
-				channel <- msg
-			}()
+			receiveMutex.Lock()
+			receive2 := receive
+			receiveMutex.Unlock()
+			if receive2 == nil {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if err := receive2(r.Context(), msg); err != nil {
+				stderr.Print(err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
 			w.Header().Set("Content-Type", "text/plain")
 			return
 		}
-		key, err := strconv.ParseUint(path, 10, 0)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if path == "members" || strings.HasPrefix(path, "members/") {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			member := strings.TrimPrefix(strings.TrimPrefix(path, "members"), "/")
+			err := error(nil)
+			switch {
+			case r.Method == "GET" && member == "":
+			case r.Method == "POST" && member != "":
+				err = node.AddMember(ctx, member)
+			case r.Method == "DELETE" && member != "":
+				err = node.RemoveMember(ctx, member)
+			default:
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			if err != nil {
+				stderr.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			members, err := node.Members(ctx)
+			if err != nil {
+				stderr.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintln(w, strings.Join(members, "\n"))
+			return
+		}
+		if path == "batch" {
+			if r.Method != "POST" {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			body := map[string]string{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			values := map[string][]byte{}
+			for key, value := range body {
+				values[key] = []byte(value)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			results, err := node.WriteBatch(ctx, values)
+			if err != nil {
+				stderr.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			type keyResult struct {
+				Value *string `json:"value,omitempty"`
+				Error string  `json:"error,omitempty"`
+			}
+			resp := map[string]*keyResult{}
+			for key, result := range results {
+				keyResult2 := &keyResult{}
+				if result.Err != nil {
+					keyResult2.Error = result.Err.Error()
+				} else {
+					value := string(result.Value)
+					keyResult2.Value = &value
+				}
+				resp[key] = keyResult2
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
+		if strings.HasPrefix(r.URL.Path, "/watch/") {
+			key := strings.TrimPrefix(r.URL.Path, "/watch/")
+			ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+			defer cancel()
+			value, ok := <-node.Watch(ctx, key)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusRequestTimeout), http.StatusRequestTimeout)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(value)
+			return
+		}
+		if path == "scan" {
+			if r.Method != "GET" {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			query := r.URL.Query()
+			from, to, limit := query.Get("from"), query.Get("to"), 0
+			if query.Get("limit") != "" {
+				if limit, err = strconv.Atoi(query.Get("limit")); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			keyValues, err := node.Scan(ctx, from, to, limit)
+			if skipped, ok := err.(*paxos.ErrSkippedKeys); ok {
+				// Answer with every key that could be read, and list the others in a header
+				stderr.Print(err)
+				skippedBytes, _ := json.Marshal(skipped.Keys)
+				w.Header().Set("X-Skipped-Keys", string(skippedBytes))
+				err = nil
+			}
+			if err != nil {
+				stderr.Print(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			type keyValue struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}
+			resp := []*keyValue{}
+			for _, keyValue2 := range keyValues {
+				resp = append(resp, &keyValue{Key: keyValue2.Key, Value: string(keyValue2.Value)})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/kv/") {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/kv/")
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		resp, err := []byte(nil), error(nil)
 		switch r.Method {
 		case "GET":
 			resp, err = node.Read(ctx, key)
+			if _, ok := err.(*paxos.ErrUndecided); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
 			if err != nil {
 				stderr.Print(err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
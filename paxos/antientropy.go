@@ -0,0 +1,190 @@
+package paxos
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// Final keys are split into this many buckets, and only buckets whose digests differ get compared
+// key by key
+const digestBuckets = 64
+
+// Anti-entropy has every node compare its final keys with a random member once per interval, and
+// each side fills in the final values the other has. It catches up nodes that were down or missed
+// a final message, but it needs storage that can list its keys. Zero turns it off, which is the
+// default. It must be set before any nodes are added.
+func (network *Network) SetAntiEntropy(interval time.Duration) {
+	network.syncInterval = interval
+}
+
+// Start a round of anti-entropy with a random member
+func (loop *nodeLoop) startSync() {
+	peers := []string{}
+	for id := range loop.members() {
+		if id != loop.id {
+			peers = append(peers, id)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	if err := loop.loadFinals(); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	loop.send(peers[rand.Intn(len(peers))], &message{
+		Type:    syncRequestType,
+		OpID:    newOpID(),
+		Digests: loop.bucketDigests(),
+	})
+}
+
+// Answer with this node's digests and every final key in the buckets that differ
+func (loop *nodeLoop) handleSyncRequest(msg *message) {
+	if len(msg.Digests) != digestBuckets {
+		return
+	}
+	if err := loop.loadFinals(); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	digests := loop.bucketDigests()
+	keys := []string{}
+	for key := range loop.finals {
+		if bucket := keyBucket(key); digests[bucket] != msg.Digests[bucket] {
+			keys = append(keys, key)
+		}
+	}
+	loop.send(msg.Sender, &message{
+		Type:    syncResponseType,
+		OpID:    msg.OpID,
+		Digests: digests,
+		Keys:    keys,
+	})
+}
+
+// Ask for the final values this node is missing, and send the ones the other node is missing
+func (loop *nodeLoop) handleSyncResponse(msg *message) {
+	if len(msg.Digests) != digestBuckets {
+		return
+	}
+	if err := loop.loadFinals(); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	theirs := map[string]struct{}{}
+	missing := []string{}
+	for _, key := range msg.Keys {
+		theirs[key] = struct{}{}
+		if _, ok := loop.finals[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if 0 < len(missing) {
+		loop.send(msg.Sender, &message{
+			Type: finalsRequestType,
+			OpID: msg.OpID,
+			Keys: missing,
+		})
+	}
+	digests := loop.bucketDigests()
+	keys := []string{}
+	for key := range loop.finals {
+		if _, ok := theirs[key]; !ok && digests[keyBucket(key)] != msg.Digests[keyBucket(key)] {
+			keys = append(keys, key)
+		}
+	}
+	loop.sendFinals(msg.Sender, msg.OpID, keys)
+}
+
+func (loop *nodeLoop) handleFinalsRequest(msg *message) {
+	loop.sendFinals(msg.Sender, msg.OpID, msg.Keys)
+}
+
+// Send the final values of some keys, skipping any this node does not have
+func (loop *nodeLoop) sendFinals(to string, opID string, keys []string) {
+	for _, key := range keys {
+		if isReserved(key) {
+			continue
+		}
+		state, err := loop.getState(key)
+		if err != nil {
+			loop.network.stderrLogger.Print(err)
+			continue
+		}
+		if !state.Final || state.Value == nil {
+			continue // Witnesses only have the hash
+		}
+		loop.send(to, &message{
+			Type:  finalType,
+			OpID:  opID,
+			Key:   key,
+			Value: state.Value,
+		})
+	}
+}
+
+// Read the hash of every final value from storage the first time anti-entropy needs them. After
+// that putState keeps them up to date.
+func (loop *nodeLoop) loadFinals() error {
+	if loop.finals != nil {
+		return nil
+	}
+	keys, err := loop.listKeys()
+	if err != nil {
+		return err
+	}
+	loop.finals = map[string]struct{}{}
+	loop.digests = make([][sha512.Size]byte, digestBuckets)
+	for _, key := range keys {
+		state, err := loop.getState(key)
+		if err != nil {
+			// Skipped like a key storage cannot list, rather than holding up every other key
+			loop.network.stderrLogger.Print(err)
+			continue
+		}
+		if state.Final {
+			loop.addFinal(key, state)
+		}
+	}
+	return nil
+}
+
+// Count a final key towards its bucket's digest. Since a final value never changes, the digest is
+// every key and hash in the bucket XORed together, which can change one key at a time.
+func (loop *nodeLoop) addFinal(key string, state *stateStruct) {
+	if _, ok := loop.finals[key]; ok {
+		return
+	}
+	loop.finals[key] = struct{}{}
+	hash := state.Hash
+	if hash == "" {
+		hash = getHash(state.Value)
+	}
+	sum := sha512.Sum512([]byte(fmt.Sprintf("%q:%s", key, hash)))
+	digest := &loop.digests[keyBucket(key)]
+	for i := range digest {
+		digest[i] ^= sum[i]
+	}
+}
+
+// The bucket a key falls in, from a cheap hash so that keys spread evenly
+func keyBucket(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % digestBuckets)
+}
+
+// The digest of each bucket, empty for empty buckets
+func (loop *nodeLoop) bucketDigests() []string {
+	digests := make([]string, digestBuckets)
+	for i, digest := range loop.digests {
+		if digest != [sha512.Size]byte{} {
+			digests[i] = fmt.Sprintf("%x", digest)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,59 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A node that missed every final value catches up without anyone reading or writing
+func TestAntiEntropy(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetAntiEntropy(50 * time.Millisecond)
+	storages := []Storage{MemoryStorage(), MemoryStorage(), newLockedStorage()}
+	keys := 20
+	for _, storage := range storages[:2] {
+		for k := 0; k < keys; k++ {
+			stateBytes, _ := json.Marshal(&stateStruct{
+				PromisedN: ballot{1, "n0"},
+				AcceptedN: ballot{1, "n0"},
+				Value:     []byte(fmt.Sprint("value", k)),
+				Final:     true,
+			})
+			storage.Put(fmt.Sprint("k", k), stateBytes)
+		}
+	}
+	for i, storage := range storages {
+		network.AddNode(fmt.Sprintf("n%d", i), storage)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for k := 0; k < keys; k++ {
+		for {
+			stateBytes, err := storages[2].Get(fmt.Sprint("k", k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := &stateStruct{}
+			if 0 < len(stateBytes) {
+				if err := json.Unmarshal(stateBytes, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if state.Final {
+				if string(state.Value) != fmt.Sprint("value", k) {
+					t.Fatalf("n2 has %q for k%d", state.Value, k)
+				}
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("n2 never learned k%d", k)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package paxos
+
+import (
+	"encoding/json"
+)
+
+// A ballot identifies a proposal. Ballots are totally ordered by round and then by the ID of the
+// proposing node, so two nodes can never propose with the same ballot.
+type ballot struct {
+	Round  uint64 `json:"round"`
+	NodeID string `json:"nodeId"`
+}
+
+func (b ballot) less(other ballot) bool {
+	if b.Round != other.Round {
+		return b.Round < other.Round
+	}
+	return b.NodeID < other.NodeID
+}
+
+func (b ballot) isZero() bool {
+	return b == ballot{}
+}
+
+// State persisted before ballots existed stores a bare round number, so accept that too
+func (b *ballot) UnmarshalJSON(data []byte) error {
+	round := uint64(0)
+	if err := json.Unmarshal(data, &round); err == nil {
+		*b = ballot{Round: round}
+		return nil
+	}
+	type ballotJSON ballot
+	return json.Unmarshal(data, (*ballotJSON)(b))
+}
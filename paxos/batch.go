@@ -0,0 +1,158 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Messages in one envelope at most, so that huge batches still go out in pieces of sensible size
+const maxBatchSize = 1000
+
+// What happened to one key of a batch
+type WriteResult struct {
+	Value []byte // The value that belongs to the key, which may not be the one written
+	Err   error
+}
+
+// Write many values at once. They run as separate rounds of Paxos, but start together so the node
+// sends each other node one message per phase that carries every key. Returns a result for every
+// key, with the context's error for any key still undecided when it is done.
+func (node *Node) WriteBatch(ctx context.Context, values map[string][]byte) (map[string]*WriteResult, error) {
+	msgs := []*message{}
+	policy := node.getRetryPolicy()
+	for key, value := range values {
+		if value == nil {
+			return nil, &ErrNilValue{}
+		}
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &message{
+			Key:         key,
+			Value:       value,
+			Ctx:         ctx,
+			RetryPolicy: policy,
+		})
+	}
+	results := map[string]*WriteResult{}
+	for i, result := range node.doBatch(ctx, node.batchChan, msgs) {
+		results[msgs[i].Key] = result
+	}
+	return results, nil
+}
+
+// Hand many operations to the node's goroutine at once and wait for every result
+func (node *Node) doBatch(ctx context.Context, channel chan<- []*message, msgs []*message) []*WriteResult {
+	respChans, errChans := []chan []byte{}, []chan error{}
+	for _, msg := range msgs {
+		respChan, errChan := make(chan []byte, 1), make(chan error, 1)
+		msg.OpID = newOpID()
+		msg.ResponseChan = respChan
+		msg.ErrChan = errChan
+		respChans, errChans = append(respChans, respChan), append(errChans, errChan)
+	}
+	results := []*WriteResult{}
+	select {
+	case channel <- msgs:
+	case <-ctx.Done():
+		for range msgs {
+			results = append(results, &WriteResult{Err: ctx.Err()})
+		}
+		return results
+	case <-node.life.done:
+		for range msgs {
+			results = append(results, &WriteResult{Err: &ErrClosed{}})
+		}
+		return results
+	}
+	for i, msg := range msgs {
+		select {
+		case resp := <-respChans[i]:
+			results = append(results, &WriteResult{Value: resp, Err: <-errChans[i]})
+		case <-ctx.Done():
+			results = append(results, &WriteResult{Err: ctx.Err()})
+			node.clean(msg.OpID)
+		case <-node.life.done:
+			results = append(results, &WriteResult{Err: &ErrClosed{}})
+		}
+	}
+	return results
+}
+
+// Hold on to a message until the node is done with what it is doing, so everything for the same
+// node goes out together
+func (loop *nodeLoop) queue(to string, msgBytes []byte) {
+	loop.outbox[to] = append(loop.outbox[to], msgBytes)
+}
+
+// Send everything queued, one envelope for each node
+func (loop *nodeLoop) flush() {
+	// Replies such as to write1 and write2 requests promise what is in storage, so it has to be
+	// durable before any of them go out. A message that cannot wait for that is lost like any other.
+	if 0 < len(loop.outbox) {
+		if err := loop.storage.Sync(); err != nil {
+			loop.network.stderrLogger.Print(err)
+			loop.outbox = map[string][][]byte{}
+			return
+		}
+	}
+	for id, msgs := range loop.outbox {
+		delete(loop.outbox, id)
+		envelopes := [][]byte{}
+		for 0 < len(msgs) {
+			size := len(msgs)
+			if maxBatchSize < size {
+				size = maxBatchSize
+			}
+			msgBytes := msgs[0]
+			if 1 < size {
+				batch := []json.RawMessage{}
+				for _, msgBytes2 := range msgs[:size] {
+					batch = append(batch, msgBytes2)
+				}
+				msgBytes = loop.network.encodeMessage(&message{
+					Type:   batchType,
+					Sender: loop.id,
+					Batch:  batch,
+				})
+			}
+			msgs = msgs[size:]
+			envelopes = append(envelopes, msgBytes)
+		}
+		id := id
+		send := loop.network.transport.Send
+		if id == loop.id {
+			// Straight back to this node, since nothing sent to itself may get lost
+			send = func(ctx context.Context, id string, msg []byte) error {
+				return loop.receive(ctx, msg)
+			}
+		}
+		loop.life.goroutine(func() {
+			// In order, so that replies come back in about the order the requests went out
+			for _, msgBytes := range envelopes {
+				if err := send(loop.life.ctx, id, msgBytes); err != nil {
+					if loop.life.ctx.Err() == nil {
+						loop.network.stderrLogger.Printf("%s cannot reach %s: %v", loop.id, id, err)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+// Handle every message in an envelope, as if each came on its own
+func (loop *nodeLoop) handleBatch(msg *message) {
+	msgs := []*message{}
+	for _, msgBytes := range msg.Batch {
+		msg2, err := loop.network.decodeMessage(msgBytes)
+		if err != nil {
+			loop.network.stderrLogger.Print(err)
+			continue
+		}
+		msgs = append(msgs, msg2)
+	}
+	for _, msg2 := range msgs {
+		loop.handleMessage(msg2)
+	}
+}
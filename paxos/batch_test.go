@@ -0,0 +1,99 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBatch(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := nodes[0].Write(ctx, "k0", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// More keys than fit in one envelope, and one that already has a value
+	values := map[string][]byte{}
+	for k := 0; k < maxBatchSize+10; k++ {
+		values[fmt.Sprint("k", k)] = []byte(fmt.Sprint("value", k))
+	}
+	results, err := nodes[1].WriteBatch(ctx, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(values) {
+		t.Fatalf("got %d results for %d keys", len(results), len(values))
+	}
+	for k, value := range values {
+		if k == "k0" {
+			value = []byte("old")
+		}
+		result := results[k]
+		if result.Err != nil {
+			t.Fatalf("writing %s: %v", k, result.Err)
+		}
+		if string(result.Value) != string(value) {
+			t.Fatalf("got %q back for %s, want %q", result.Value, k, value)
+		}
+	}
+	for k := 0; k < 10; k++ {
+		key := fmt.Sprint("k", k)
+		checkAgreement(ctx, t, nodes, key, map[string]bool{string(results[key].Value): true})
+	}
+
+	if _, err := nodes[0].WriteBatch(ctx, map[string][]byte{"k1": []byte("x"), "k2": nil}); err == nil {
+		t.Fatal("wrote a nil value")
+	} else if _, ok := err.(*ErrNilValue); !ok {
+		t.Fatalf("got %v, want ErrNilValue", err)
+	}
+	if _, err := nodes[0].WriteBatch(ctx, map[string][]byte{metaKey: []byte("x")}); err == nil {
+		t.Fatal("wrote a reserved key")
+	} else if _, ok := err.(*ErrReservedKey); !ok {
+		t.Fatalf("got %v, want ErrReservedKey", err)
+	}
+}
+
+// Batches from every node over the same keys still agree on each key
+func TestWriteBatchContention(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	keys := 20
+	wg := sync.WaitGroup{}
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values := map[string][]byte{}
+			for k := 0; k < keys; k++ {
+				values[fmt.Sprint("k", k)] = []byte(fmt.Sprintf("n%d", i))
+			}
+			results, err := nodes[i].WriteBatch(ctx, values)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for k, result := range results {
+				if result.Err != nil {
+					t.Errorf("n%d writing %s: %v", i, k, result.Err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	written := map[string]bool{"n0": true, "n1": true, "n2": true}
+	for k := 0; k < keys; k++ {
+		checkAgreement(ctx, t, nodes, fmt.Sprint("k", k), written)
+	}
+}
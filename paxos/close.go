@@ -0,0 +1,109 @@
+package paxos
+
+import (
+	"context"
+	"sync"
+)
+
+// The goroutines of a node, which all stop once the node closes
+type lifecycle struct {
+	mutex  sync.Mutex
+	closed bool
+	ctx    context.Context // Done when the node closes
+	cancel context.CancelFunc
+	done   <-chan struct{} // Same as ctx.Done()
+	group  sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, done: ctx.Done()}
+}
+
+// Run f in a goroutine that Close waits for. Returns false without running it if the node is
+// closed, since whatever it would do no longer matters.
+func (life *lifecycle) goroutine(f func()) bool {
+	life.mutex.Lock()
+	defer life.mutex.Unlock()
+	if life.closed {
+		return false
+	}
+	life.group.Add(1)
+	go func() {
+		defer life.group.Done()
+		f()
+	}()
+	return true
+}
+
+// Tell every goroutine to stop, without waiting for them
+func (life *lifecycle) stop() {
+	life.mutex.Lock()
+	defer life.mutex.Unlock()
+	if !life.closed {
+		life.closed = true
+		life.cancel()
+	}
+}
+
+// Stop and wait for every goroutine to exit, or for ctx to be done
+func (life *lifecycle) close(ctx context.Context) error {
+	life.stop()
+	exited := make(chan struct{})
+	go func() {
+		life.group.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop the node. It takes no more operations, and any in progress fail with ErrClosed. Messages
+// still on their way to other nodes are dropped. Returns once all of the node's goroutines have
+// exited and its storage has closed, or with the context's error if that takes too long.
+func (node *Node) Close(ctx context.Context) error {
+	node.network.removeNode(node)
+	if err := node.life.close(ctx); err != nil {
+		return err
+	}
+	return node.storage.Close()
+}
+
+// Close every local node on the network, then the transport. Returns the first error any of them
+// ran into, after trying to close all of them.
+func (network *Network) Close(ctx context.Context) error {
+	network.mutex.Lock()
+	nodes := []*Node{}
+	for _, node := range network.nodes {
+		nodes = append(nodes, node)
+	}
+	network.mutex.Unlock()
+	for _, node := range nodes {
+		node.life.stop() // All at once, so none of them waits on another to close
+	}
+	err := error(nil)
+	for _, node := range nodes {
+		if err2 := node.Close(ctx); err == nil {
+			err = err2
+		}
+	}
+	if err2 := network.transport.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Forget a node that is closing, unless another node took over its id
+func (network *Network) removeNode(node *Node) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if network.nodes[node.id] != node {
+		return
+	}
+	delete(network.nodes, node.id)
+	network.transport.Listen(node.id, nil)
+}
@@ -0,0 +1,117 @@
+package paxos
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	network := NewNetwork()
+	network.SetMultiPaxos(true)
+	network.SetAntiEntropy(10 * time.Millisecond)
+	nodes := addTestNodes(network, 3)
+	node := network.AddNode("n3", MemoryStorage())
+	network.AddRemoteNode("n4") // Nothing listens for it, like a node that is down
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := nodes[0].Write(ctx, "k1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything waiting on a node fails once it closes, even without a quorum to answer
+	watch := nodes[1].WatchRange(ctx, "k10", "k20")
+	errs := make(chan error)
+	for _, node := range nodes {
+		go func(node *Node) {
+			_, err := node.Write(ctx, "k2", []byte("y"))
+			errs <- err
+		}(node)
+	}
+	if err := network.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for range nodes {
+		if err := <-errs; err != nil {
+			if _, ok := err.(*ErrClosed); !ok {
+				t.Fatalf("got %v, want ErrClosed or nil", err)
+			}
+		}
+	}
+	if _, ok := <-watch; ok {
+		t.Fatal("watched a key after closing")
+	}
+	if _, err := node.Read(ctx, "k1"); err == nil {
+		t.Fatal("read from a closed node")
+	} else if _, ok := err.(*ErrClosed); !ok {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if _, err := nodes[0].Write(ctx, "k3", []byte("z")); err == nil {
+		t.Fatal("wrote to a closed node")
+	} else if _, ok := err.(*ErrClosed); !ok {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if _, ok := <-nodes[0].Watch(ctx, "k1"); ok {
+		t.Fatal("watched a key on a closed node")
+	}
+	if err := nodes[0].Close(ctx); err != nil {
+		t.Fatalf("closing twice: %v", err)
+	}
+
+	// No goroutine outlives its node
+	for goroutines < runtime.NumGoroutine() {
+		select {
+		case <-ctx.Done():
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines before, %d after closing\n%s", goroutines, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Storage that fails to close
+type unclosableStorage struct {
+	Storage
+}
+
+func (s *unclosableStorage) Close() error {
+	return errors.New("close failed")
+}
+
+// Transport that notes when it closes
+type closeTrackingTransport struct {
+	Transport
+	closed bool
+}
+
+func (t *closeTrackingTransport) Close() error {
+	t.closed = true
+	return t.Transport.Close()
+}
+
+// One node failing to close still closes the rest and the transport
+func TestCloseAfterError(t *testing.T) {
+	network := NewNetwork()
+	transport := &closeTrackingTransport{Transport: MemoryTransport()}
+	network.SetTransport(transport)
+	network.AddNode("n0", &unclosableStorage{MemoryStorage()})
+	nodes := []*Node{network.AddNode("n1", MemoryStorage()), network.AddNode("n2", MemoryStorage())}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := network.Close(ctx); err == nil || err.Error() != "close failed" {
+		t.Fatalf("got %v, want the storage's error", err)
+	}
+	for _, node := range nodes {
+		if _, err := node.Read(ctx, "k1"); err == nil {
+			t.Fatal("read from a closed node")
+		} else if _, ok := err.(*ErrClosed); !ok {
+			t.Fatalf("got %v, want ErrClosed", err)
+		}
+	}
+	if !transport.closed {
+		t.Fatal("transport left open")
+	}
+}
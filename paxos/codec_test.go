@@ -0,0 +1,200 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *message
+	}{
+		{"empty", &message{}},
+		{"nil and empty values", &message{
+			Type:    batchType,
+			Value:   []byte{},
+			Batch:   []json.RawMessage{nil, {}, json.RawMessage(`{"type":1}`)},
+			Entries: []*message{{Key: "nil"}, {Key: "empty", Value: []byte{}}},
+		}},
+		{"every field", &message{
+			Type:      write2RequestType,
+			Sender:    "n1",
+			OpID:      newOpID(),
+			Key:       "k\x00\xff",
+			Value:     []byte("value"),
+			Hash:      "abc",
+			N:         ballot{Round: 1 << 40, NodeID: "n1"},
+			AcceptedN: ballot{Round: 3, NodeID: "n2"},
+			PromisedN: ballot{Round: 4, NodeID: "n3"},
+			Epoch:     7,
+			Digests:   []string{"", "d1"},
+			Keys:      []string{"a", "b"},
+			AllKeys:   true,
+			From:      "a",
+			To:        "z",
+			Limit:     5,
+		}},
+		{"nested entries", &message{
+			Type: leaderPromiseType,
+			Entries: []*message{
+				{Key: "a", Value: []byte("1"), AcceptedN: ballot{Round: 2, NodeID: "n1"}},
+				{Key: "b", Entries: []*message{{Key: "c", Keys: []string{"d"}}}},
+			},
+		}},
+	}
+	codec := BinaryCodec()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := codec.Marshal(test.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &message{}
+			if err := codec.Unmarshal(data, msg); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(msg, test.msg) {
+				t.Fatalf("got %+v, want %+v", msg, test.msg)
+			}
+		})
+	}
+}
+
+// Keys are any bytes, which JSON strings cannot hold unless they are UTF-8
+func TestJSONCodecKeys(t *testing.T) {
+	codec := JSONCodec()
+	for _, key := range []string{"", "a", "é", "\xff\x01", "k\x00\xff"} {
+		want := &message{
+			Type:    keysResponseType,
+			Sender:  "n1",
+			Key:     key,
+			Value:   []byte("value"),
+			Entries: []*message{{Key: key, Value: []byte("1")}},
+			Keys:    []string{key, "b"},
+			From:    key,
+			To:      key + "z",
+		}
+		data, err := codec.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &message{}
+		if err := codec.Unmarshal(data, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		// Nodes from before keys went as base64 still read UTF-8 keys
+		if plain, _ := json.Marshal((*plainMessage)(want)); utf8.ValidString(key) && !bytes.Equal(data, plain) {
+			t.Fatalf("got %s, want %s", data, plain)
+		}
+	}
+}
+
+func TestBinaryCodecInvalid(t *testing.T) {
+	codec := BinaryCodec()
+	data, err := codec.Marshal(&message{
+		Type:    write1RequestType,
+		Sender:  "n1",
+		Key:     "k",
+		Value:   []byte("value"),
+		Entries: []*message{{Key: "a"}},
+		Keys:    []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"nil", nil},
+		{"version only", data[:1]},
+		{"unknown version", append([]byte{binaryVersion + 1}, data[1:]...)},
+		{"json", []byte(`{"type":1}`)},
+		{"trailing bytes", append(append([]byte{}, data...), 0)},
+		{"huge length", []byte{binaryVersion, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"unterminated varint", []byte{binaryVersion, 0x80}},
+	}
+	for i := 1; i < len(data); i++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{"truncated", data[:i]})
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := codec.Unmarshal(test.data, &message{})
+			if _, ok := err.(*ErrInvalidMessage); !ok {
+				t.Fatalf("got %v, want ErrInvalidMessage", err)
+			}
+		})
+	}
+	if _, err := codec.Marshal("not a message"); err == nil {
+		t.Fatal("encoded something other than a message")
+	}
+}
+
+// A node decodes messages from the built in codecs no matter which one it sends with
+func TestDecodeMessageFallback(t *testing.T) {
+	msg := &message{Type: readRequestType, Sender: "n1", Key: "k", Value: []byte("v")}
+	codecs := map[string]Codec{"json": JSONCodec(), "binary": BinaryCodec()} // {name: codec}
+	for sendName, send := range codecs {
+		for receiveName, receive := range codecs {
+			t.Run(sendName+" to "+receiveName, func(t *testing.T) {
+				data, err := send.Marshal(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				network := NewNetwork()
+				network.SetCodec(receive)
+				got, err := network.decodeMessage(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Fatalf("got %+v, want %+v", got, msg)
+				}
+			})
+		}
+	}
+}
+
+// A codec of your own carries every message, even one that neither built in codec can read
+func TestFuncCodec(t *testing.T) {
+	marshaled := int64(0)
+	codec := FuncCodec(&CodecFuncs{
+		Marshal: func(v interface{}) ([]byte, error) {
+			atomic.AddInt64(&marshaled, 1)
+			data, err := json.Marshal(v)
+			return append([]byte("custom"), data...), err
+		},
+		Unmarshal: func(data []byte, v interface{}) error {
+			if !bytes.HasPrefix(data, []byte("custom")) {
+				return &ErrInvalidMessage{}
+			}
+			return json.Unmarshal(data[len("custom"):], v)
+		},
+	})
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetCodec(codec)
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := nodes[0].Write(ctx, "k", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	checkAgreement(ctx, t, nodes, "k", map[string]bool{"x": true})
+	if atomic.LoadInt64(&marshaled) == 0 {
+		t.Fatal("never used the codec")
+	}
+}
@@ -1,7 +1,168 @@
 package paxos
 
+import (
+	"fmt"
+)
+
 type ErrNilValue struct{}
 
 func (e *ErrNilValue) Error() string {
 	return "Value cannot be nil"
 }
+
+type ErrReservedKey struct {
+	Key string
+}
+
+func (e *ErrReservedKey) Error() string {
+	return fmt.Sprintf("Key %q is reserved for internal use", e.Key)
+}
+
+type ErrKeyTooLong struct {
+	Key string
+}
+
+func (e *ErrKeyTooLong) Error() string {
+	return fmt.Sprintf("Key %q is longer than %d bytes", e.Key, MaxKeySize)
+}
+
+type ErrInvalidLogEntry struct {
+	Key string
+}
+
+func (e *ErrInvalidLogEntry) Error() string {
+	return fmt.Sprintf("Key %q does not hold a log entry", e.Key)
+}
+
+type ErrMaxAttempts struct {
+	Key      string
+	Attempts int
+}
+
+func (e *ErrMaxAttempts) Error() string {
+	return fmt.Sprintf("Gave up writing key %q after %d attempts", e.Key, e.Attempts)
+}
+
+type ErrInvalidRetryPolicy struct {
+	Field string
+}
+
+func (e *ErrInvalidRetryPolicy) Error() string {
+	return fmt.Sprintf("Retry policy has an invalid %s", e.Field)
+}
+
+type ErrUndecided struct {
+	Key string
+}
+
+func (e *ErrUndecided) Error() string {
+	return fmt.Sprintf("Key %q has a write in progress, try again later", e.Key)
+}
+
+type ErrMembershipChanged struct {
+	Epoch uint64
+}
+
+func (e *ErrMembershipChanged) Error() string {
+	return fmt.Sprintf("A different membership change was decided for epoch %d", e.Epoch)
+}
+
+type ErrNoMembers struct{}
+
+func (e *ErrNoMembers) Error() string {
+	return "Cannot remove the last member"
+}
+
+type ErrLearner struct {
+	ID string
+}
+
+func (e *ErrLearner) Error() string {
+	return fmt.Sprintf("%s is a learner, which cannot become a member", e.ID)
+}
+
+type ErrCannotListKeys struct{}
+
+func (e *ErrCannotListKeys) Error() string {
+	return "Storage cannot list its keys, which changing members, scans and lease reads need"
+}
+
+type ErrInvalidQuorums struct {
+	Phase1 int
+	Phase2 int
+	Weight int
+}
+
+func (e *ErrInvalidQuorums) Error() string {
+	return fmt.Sprintf("Quorums of %d and %d do not overlap or do not fit in a total weight of %d", e.Phase1, e.Phase2, e.Weight)
+}
+
+type ErrInvalidWeight struct {
+	ID     string
+	Weight int
+}
+
+func (e *ErrInvalidWeight) Error() string {
+	return fmt.Sprintf("Weight %d for %s cannot be negative", e.Weight, e.ID)
+}
+
+type ErrUnreachable struct {
+	ID string
+}
+
+func (e *ErrUnreachable) Error() string {
+	return fmt.Sprintf("No way to reach %s", e.ID)
+}
+
+type ErrQueueFull struct {
+	ID string
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("Too many messages are waiting to go out to %s", e.ID)
+}
+
+type ErrClosed struct{}
+
+func (e *ErrClosed) Error() string {
+	return "Node is closed"
+}
+
+type ErrCannotEncode struct {
+	Value interface{}
+}
+
+func (e *ErrCannotEncode) Error() string {
+	return fmt.Sprintf("Codec cannot encode or decode %T", e.Value)
+}
+
+type ErrInvalidMessage struct{}
+
+func (e *ErrInvalidMessage) Error() string {
+	return "Message is truncated or malformed"
+}
+
+type ErrCorruptStorage struct {
+	Path string
+}
+
+func (e *ErrCorruptStorage) Error() string {
+	return fmt.Sprintf("%s is corrupt", e.Path)
+}
+
+type ErrSkippedKeys struct {
+	Keys []string
+	Errs []error // Why each key was skipped
+}
+
+func (e *ErrSkippedKeys) Error() string {
+	return fmt.Sprintf("Skipped %d keys that could not be read, such as %q: %v", len(e.Keys), e.Keys[0], e.Errs[0])
+}
+
+type ErrWriteTooLarge struct {
+	Size int
+}
+
+func (e *ErrWriteTooLarge) Error() string {
+	return fmt.Sprintf("Write of %d bytes is too large for storage", e.Size)
+}
@@ -0,0 +1,138 @@
+package paxos
+
+// The fast round every key starts with. It is lower than any classic ballot, so acceptors can take
+// a value in it without a phase 1, but only the first value they see.
+var fastBallot = ballot{Round: 0, NodeID: "fast"}
+
+// Fast Paxos mode sends each write straight to the acceptors in the fast round, which decides it
+// in one round trip when nothing else is written to the key at the same time. Writes that collide
+// fall back to the classic rounds. It must be set the same way on every node, and does nothing in
+// Multi-Paxos mode.
+func (network *Network) SetFastPaxos(enabled bool) {
+	network.fastPaxos = enabled
+}
+
+// Propose a value in the fast round
+func (loop *nodeLoop) startFast(msg *message) {
+	loop.proposedValueMap[msg.OpID] = msg.Value
+	loop.msgMap[msg.OpID] = msg
+	loop.fastVotesMap[msg.OpID] = map[string]struct{}{}
+	request := &message{
+		Type:  fastRequestType,
+		OpID:  msg.OpID,
+		N:     fastBallot,
+		Key:   msg.Key,
+		Value: msg.Value,
+	}
+	loop.fastWaitingMap[msg.OpID] = loop.broadcast(request)
+	loop.expect(request)
+}
+
+// Accept the value unless this node already accepted something, and report what it has
+func (loop *nodeLoop) handleFastRequest(msg *message, state *stateStruct) {
+	if promisedN := loop.promisedN(state); !fastBallot.less(promisedN) && state.AcceptedN.isZero() {
+		state.PromisedN = fastBallot
+		state.AcceptedN = fastBallot
+		state.Value = msg.Value
+		if err := loop.putState(msg.Key, state); err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+	}
+	loop.send(msg.Sender, &message{
+		Type:      fastResponseType,
+		OpID:      msg.OpID,
+		N:         fastBallot,
+		AcceptedN: state.AcceptedN,
+		Key:       msg.Key,
+		Value:     state.Value,
+		Hash:      state.Hash,
+	})
+}
+
+func (loop *nodeLoop) handleFastResponse(msg *message) {
+	waitingMap, ok := loop.fastWaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	if _, ok := waitingMap[msg.Sender]; !ok {
+		return
+	}
+	delete(waitingMap, msg.Sender)
+	value := loop.proposedValueMap[msg.OpID]
+	votesMap := loop.fastVotesMap[msg.OpID]
+	if msg.AcceptedN == fastBallot && valueHash(msg) == getHash(value) {
+		votesMap[msg.Sender] = struct{}{}
+	}
+
+	if loop.isQuorum(votesMap, fastPhase) {
+		delete(loop.fastWaitingMap, msg.OpID)
+		loop.broadcastFinal(&message{
+			Type:  finalType,
+			OpID:  msg.OpID,
+			Key:   msg.Key,
+			Value: value,
+		})
+		return
+	}
+	possibleMap := map[string]struct{}{}
+	for id := range votesMap {
+		possibleMap[id] = struct{}{}
+	}
+	for id := range waitingMap {
+		possibleMap[id] = struct{}{}
+	}
+	if !loop.isQuorum(possibleMap, fastPhase) {
+		// Collided with another value, so let a classic round sort it out
+		loop.fallBack(msg.OpID)
+	}
+}
+
+// Give up on the fast round and let a classic round decide
+func (loop *nodeLoop) fallBack(opID string) {
+	delete(loop.fastWaitingMap, opID)
+	delete(loop.fastVotesMap, opID)
+	if msg, ok := loop.msgMap[opID]; ok {
+		loop.startWrite(msg)
+	}
+}
+
+// Remember who phase 1 finds accepted what in the fast round, where acceptors can disagree
+func (loop *nodeLoop) recordFastAccepted(msg *message) {
+	if msg.AcceptedN != fastBallot {
+		return
+	}
+	hash := valueHash(msg)
+	acceptedMap, ok := loop.fastAcceptedMap[msg.OpID]
+	if !ok {
+		acceptedMap = map[string]map[string]struct{}{}
+		loop.fastAcceptedMap[msg.OpID] = acceptedMap
+		loop.fastValueMap[msg.OpID] = map[string][]byte{}
+	}
+	if _, ok := acceptedMap[hash]; !ok {
+		acceptedMap[hash] = map[string]struct{}{}
+	}
+	acceptedMap[hash][msg.Sender] = struct{}{}
+	if msg.Value != nil {
+		loop.fastValueMap[msg.OpID][hash] = msg.Value
+	}
+}
+
+// The hash of the value phase 1 has to propose when the highest ballot it found is the fast round.
+// That is the value a fast quorum could have accepted, if any, since quorums overlap enough for
+// there to be only one. Empty when nothing could have been chosen.
+func (loop *nodeLoop) fastHash(opID string, waitingMap map[string]struct{}) string {
+	for hash, votes := range loop.fastAcceptedMap[opID] {
+		possibleMap := map[string]struct{}{}
+		for id := range votes {
+			possibleMap[id] = struct{}{}
+		}
+		for id := range waitingMap {
+			possibleMap[id] = struct{}{}
+		}
+		if loop.isQuorum(possibleMap, fastPhase) {
+			return hash
+		}
+	}
+	return ""
+}
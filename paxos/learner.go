@@ -0,0 +1,47 @@
+package paxos
+
+// Creates a local learner, which hears about every final value and can serve reads but never votes,
+// so it can sit far away from the members without slowing down or weakening writes
+func (network *Network) AddLearner(id string, storage Storage) *Node {
+	network.mutex.Lock()
+	network.learners[id] = struct{}{}
+	network.mutex.Unlock()
+	return network.addNode(id, storage, true)
+}
+
+// Tell the local nodes about a learner somewhere else, so they send it final values
+func (network *Network) AddRemoteLearner(id string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.learners[id] = struct{}{}
+}
+
+func (network *Network) isLearner(id string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	_, ok := network.learners[id]
+	return ok
+}
+
+// Add the learners to some nodes, for messages every node should hear
+func (loop *nodeLoop) withLearners(ids map[string]struct{}) map[string]struct{} {
+	loop.network.mutex.Lock()
+	defer loop.network.mutex.Unlock()
+	for id := range loop.network.learners {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+// Whether a learner should ignore a message because only voters handle it
+func (loop *nodeLoop) learnerIgnores(msg *message) bool {
+	if !loop.learner {
+		return false
+	}
+	switch msg.Type {
+	case write1RequestType, write2RequestType, fastRequestType, leaderPrepareType, keysRequestType, installType:
+		loop.network.stderrLogger.Printf("%s is a learner and does not vote", loop.id)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Memory storage that a test can look at while its node uses it
+type lockedStorage struct {
+	mutex   sync.Mutex
+	storage Storage
+}
+
+func newLockedStorage() *lockedStorage {
+	return &lockedStorage{storage: MemoryStorage()}
+}
+
+func (s *lockedStorage) Get(key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.Get(key)
+}
+
+func (s *lockedStorage) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.Put(key, value)
+}
+
+func (s *lockedStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.Delete(key)
+}
+
+func (s *lockedStorage) Iterate(from, to string, f func(key string, value []byte) bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.Iterate(from, to, f)
+}
+
+func (s *lockedStorage) Batch(writes map[string][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.Batch(writes)
+}
+
+func (s *lockedStorage) Sync() error {
+	return nil
+}
+
+func (s *lockedStorage) Close() error {
+	return nil
+}
+
+func TestLearner(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	storage := newLockedStorage()
+	learner := network.AddLearner("learner", storage)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for k := 0; k < 10; k++ {
+		if _, err := nodes[k%3].Write(ctx, fmt.Sprint("k", k), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every final value reaches the learner without it asking
+	for k := 0; k < 10; k++ {
+		key := fmt.Sprint("k", k)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			stateBytes, err := storage.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := &stateStruct{}
+			if stateBytes != nil {
+				if err := json.Unmarshal(stateBytes, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if state.Final && string(state.Value) == "x" {
+				break
+			}
+			if deadline.Before(time.Now()) {
+				t.Fatalf("learner has %+v for %s", state, key)
+			}
+		}
+		if value, err := learner.Read(ctx, key); err != nil || string(value) != "x" {
+			t.Fatalf("learner read %q, %v for %s", value, err, key)
+		}
+	}
+
+	// It never counts toward a quorum
+	members, err := learner.Members(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"n0", "n1", "n2"}; !reflect.DeepEqual(members, want) {
+		t.Fatalf("got members %v, want %v", members, want)
+	}
+	if err := nodes[0].AddMember(ctx, "learner"); err == nil {
+		t.Fatal("added a learner as a member")
+	} else if _, ok := err.(*ErrLearner); !ok {
+		t.Fatalf("got %v, want ErrLearner", err)
+	}
+}
@@ -0,0 +1,160 @@
+package paxos
+
+import (
+	"time"
+)
+
+const (
+	leaseDuration = electionTimeout
+	maxClockDrift = leaseDuration / 10 // How much a lease can shrink by when clocks run at different speeds
+)
+
+// Lease reads let the leader in Multi-Paxos mode answer reads from its own storage. Each heartbeat
+// asks the other nodes for a lease, and while a quorum has granted one none of them will help any
+// other node decide anything, so the leader knows every value there is. The leader gives up its
+// lease a little early in case its clock runs slow. Every node's storage has to be able to list its
+// keys, and it must be set the same way on every node before any nodes are added. It does nothing
+// unless Multi-Paxos is on too, since only a leader reads with a lease.
+func (network *Network) SetLeaseReads(enabled bool) {
+	network.leaseReads = enabled
+}
+
+// Whether nodes grant and read with leases
+func (network *Network) leasesOn() bool {
+	return network.leaseReads && network.multiPaxos
+}
+
+// Heartbeats the leader sent, waiting on a quorum to grant a lease
+type leaseRound struct {
+	sent   time.Time
+	grants map[string]struct{} // {sender: null}
+}
+
+// Answer a read without asking anyone if this node knows the answer for sure. A final value never
+// changes, so any node can give it. Anything else needs the leader's lease.
+func (loop *nodeLoop) readLocal(key string) ([]byte, bool) {
+	state, err := loop.getState(key)
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		return nil, false
+	}
+	if state.Final && state.Hash == "" {
+		return state.Value, true
+	}
+	leader := loop.leader
+	if leader == nil || !leader.active || !time.Now().Before(leader.leaseUntil) || leader.keysUnknown {
+		return nil, false
+	}
+	if _, ok := leader.proposals[key]; ok {
+		return nil, false // May be chosen and known elsewhere before this node hears of it
+	}
+	if _, ok := leader.listedKeys[key]; ok {
+		return nil, false // Another node has something for it that this node may not
+	}
+	if !state.AcceptedN.isZero() {
+		return nil, false
+	}
+	return nil, true
+}
+
+// Start asking for a lease with this heartbeat
+func (loop *nodeLoop) startLease(opID string) {
+	leader := loop.leader
+	now := time.Now()
+	for opID2, round := range leader.leaseRounds {
+		if round.sent.Add(leaseDuration).Before(now) {
+			delete(leader.leaseRounds, opID2)
+		}
+	}
+	leader.leaseRounds[opID] = &leaseRound{
+		sent:   now,
+		grants: map[string]struct{}{},
+	}
+}
+
+// Promise the leader not to help any other round until the lease runs out
+func (loop *nodeLoop) grantLease(msg *message) {
+	if !loop.network.leasesOn() || msg.N != loop.meta.PromisedN || loop.meta.LeaseBlocked {
+		return
+	}
+	loop.grantN = msg.N
+	loop.grantUntil = time.Now().Add(leaseDuration)
+	loop.send(msg.Sender, &message{
+		Type: leaseGrantType,
+		OpID: msg.OpID,
+		N:    msg.N,
+	})
+}
+
+func (loop *nodeLoop) handleLeaseGrant(msg *message) {
+	leader := loop.leader
+	if leader == nil || !leader.active || leader.n != msg.N {
+		return
+	}
+	round, ok := leader.leaseRounds[msg.OpID]
+	if !ok {
+		return
+	}
+	round.grants[msg.Sender] = struct{}{}
+	// The grants have to overlap with every quorum that could promise or accept something else
+	if !loop.isQuorum(round.grants, phase1) || !loop.isQuorum(round.grants, phase2) {
+		return
+	}
+	if until := round.sent.Add(leaseDuration - maxClockDrift); leader.leaseUntil.Before(until) {
+		leader.leaseUntil = until
+	}
+	delete(leader.leaseRounds, msg.OpID)
+}
+
+// Whether a prepare has to wait for the lease this node granted to run out. The leader that holds
+// the lease can always take over from itself.
+func (loop *nodeLoop) leaseRefusesPrepare(n ballot) bool {
+	return loop.network.leasesOn() && n.NodeID != loop.grantN.NodeID && time.Now().Before(loop.grantUntil)
+}
+
+// Whether a round that is not the leader's has to wait for the lease this node granted to run out.
+// Either way this node grants no more leases until the next leader, since the leader would not
+// know what the round decides.
+func (loop *nodeLoop) leaseRefuses(n ballot) bool {
+	if !loop.network.leasesOn() || n == loop.meta.PromisedN {
+		return false
+	}
+	if !loop.meta.LeaseBlocked {
+		loop.meta.LeaseBlocked = true
+		if err := loop.putMeta(); err != nil {
+			loop.network.stderrLogger.Print(err)
+		}
+	}
+	return time.Now().Before(loop.grantUntil)
+}
+
+// Every key this node has state for, other than reserved ones
+func (loop *nodeLoop) listKeys() ([]string, error) {
+	keys := []string{}
+	err := loop.iterate("", "", func(key string, value []byte) bool {
+		if !isReserved(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Iterate over storage, once it has everything written so far. Keys storage cannot read are only
+// logged, so that they hold up nothing else.
+func (loop *nodeLoop) iterate(from, to string, f func(key string, value []byte) bool) error {
+	loop.commit()
+	err := loop.storage.Iterate(from, to, f)
+	if _, ok := err.(*ErrSkippedKeys); ok {
+		loop.network.stderrLogger.Print(err)
+		return nil
+	}
+	return err
+}
+
+// Whether storage can list its keys, found by listing none of them
+func (loop *nodeLoop) canListKeys() bool {
+	err := loop.storage.Iterate(metaKey, metaKey, func(key string, value []byte) bool { return false })
+	_, ok := err.(*ErrCannotListKeys)
+	return !ok
+}
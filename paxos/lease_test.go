@@ -0,0 +1,101 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+var readRequestPattern = regexp.MustCompile(fmt.Sprintf(`\{"type":%d,"sender":"([^"]*)"`, readRequestType))
+
+// Counts the read requests each node sends, from the messages that nodes log as they get them
+type readCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int // {sender: count}
+}
+
+func (c *readCounter) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, match := range readRequestPattern.FindAllSubmatch(p, -1) {
+		c.counts[string(match[1])]++
+	}
+	return len(p), nil
+}
+
+func (c *readCounter) count(id string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[id]
+}
+
+func TestLeaseReads(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	counter := &readCounter{counts: map[string]int{}}
+	network.SetLoggers(log.New(counter, "", 0), log.New(ioutil.Discard, "", 0))
+	network.SetMultiPaxos(true)
+	network.SetLeaseReads(true)
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := nodes[1].Write(ctx, "k1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the leader holds a lease, it reads a key nobody wrote without asking anyone. Every other
+	// node still has to ask a quorum, each of which logs the request before it answers.
+	leader := -1
+	for deadline := time.Now().Add(10 * time.Second); leader == -1; time.Sleep(50 * time.Millisecond) {
+		if deadline.Before(time.Now()) {
+			t.Fatal("no node read with a lease")
+		}
+		for i, node := range nodes {
+			id := fmt.Sprintf("n%d", i)
+			before := counter.count(id)
+			value, err := node.Read(ctx, "k2")
+			if err != nil || value != nil {
+				t.Fatalf("n%d read %q, %v for a key nobody wrote", i, value, err)
+			}
+			if counter.count(id) == before {
+				leader = i
+			}
+		}
+	}
+
+	// The leader learns of new writes as it makes them, so its lease reads keep up
+	for k := 10; k < 20; k++ {
+		key, value := fmt.Sprint("k", k), []byte(fmt.Sprint(k))
+		if _, err := nodes[(leader+1)%3].Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := nodes[leader].Read(ctx, key); err != nil || string(got) != string(value) {
+			t.Fatalf("leader read %q, %v for %s, want %q", got, err, key, value)
+		}
+	}
+	if value, err := nodes[leader].Read(ctx, "k1"); err != nil || string(value) != "x" {
+		t.Fatalf("leader read %q, %v, want x", value, err)
+	}
+}
+
+// Without Multi-Paxos there is no leader to read with a lease, so nodes do not grant any, not even
+// the one each assumes it granted before it started
+func TestLeaseReadsWithoutMultiPaxos(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetLeaseReads(true)
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), leaseDuration/2)
+	defer cancel()
+	for i, node := range nodes {
+		if _, err := node.Write(ctx, "k1", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("n%d: %v", i, err)
+		}
+	}
+	checkAgreement(ctx, t, nodes, "k1", map[string]bool{"0": true})
+}
@@ -0,0 +1,164 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+const (
+	noopEntry byte = iota
+	commandEntry
+)
+
+// A replicated log on top of a node. Entry i is decided by Paxos on the key prefix followed by i as
+// 20 digits, so the entries sort in order, and decided entries are handed to apply in order. Safe
+// for concurrent use.
+//
+//     log := paxos.NewLog(node, "log/", func(index uint64, cmd []byte) { ... })
+//     log.Append(ctx, cmd)
+type Log struct {
+	node   *Node
+	prefix string
+	apply  func(index uint64, cmd []byte)
+
+	applyMutex sync.Mutex // Held while applying, so apply is never called concurrently
+
+	mutex   sync.Mutex
+	next    uint64            // Next index to try appending at
+	applied uint64            // Every entry before this index has been applied
+	decided map[uint64][]byte // {index: entry} decided but not applied yet
+}
+
+// Creates a log whose entries are stored on the node under keys that start with prefix. The apply
+// func is called once per command, in index order.
+func NewLog(node *Node, prefix string, apply func(index uint64, cmd []byte)) *Log {
+	return &Log{
+		node:    node,
+		prefix:  prefix,
+		apply:   apply,
+		decided: map[uint64][]byte{},
+	}
+}
+
+// The key that holds an entry
+func (log *Log) key(index uint64) string {
+	return fmt.Sprintf("%s%020d", log.prefix, index)
+}
+
+// Append a command to the log. Returns the index it landed at once it and every entry before it
+// have been applied. Entries that nobody finished deciding are filled with no-ops.
+func (log *Log) Append(ctx context.Context, cmd []byte) (uint64, error) {
+	// A random ID tells this entry apart from an identical command appended by someone else
+	entry := make([]byte, 17)
+	entry[0] = commandEntry
+	rand.Read(entry[1:])
+	entry = append(entry, cmd...)
+
+	for {
+		index := log.reserve()
+		value, err := log.node.Write(ctx, log.key(index), entry)
+		if err != nil {
+			return 0, err
+		}
+		log.learn(index, value)
+		if bytes.Equal(value, entry) {
+			return index, log.fill(ctx, index+1)
+		}
+		// Somebody else got this index, try the next one
+	}
+}
+
+// Apply everything that other nodes have appended, up to the first entry that is not decided
+func (log *Log) Sync(ctx context.Context) error {
+	log.applyMutex.Lock()
+	defer log.applyMutex.Unlock()
+	for {
+		index, value, ok := log.lookup()
+		if !ok {
+			value2, err := log.node.Read(ctx, log.key(index))
+			if _, ok := err.(*ErrUndecided); ok {
+				return nil // Still being appended
+			}
+			if err != nil {
+				return err
+			}
+			if value2 == nil {
+				return nil // Caught up
+			}
+			log.learn(index, value2)
+			value = value2
+		}
+		if err := log.applyEntry(index, value); err != nil {
+			return err
+		}
+	}
+}
+
+// Apply every entry before end, proposing no-ops for any that are not decided
+func (log *Log) fill(ctx context.Context, end uint64) error {
+	log.applyMutex.Lock()
+	defer log.applyMutex.Unlock()
+	for {
+		index, value, ok := log.lookup()
+		if end <= index {
+			return nil
+		}
+		if !ok {
+			value2, err := log.node.Write(ctx, log.key(index), []byte{noopEntry})
+			if err != nil {
+				return err
+			}
+			log.learn(index, value2)
+			value = value2
+		}
+		if err := log.applyEntry(index, value); err != nil {
+			return err
+		}
+	}
+}
+
+// Must hold applyMutex
+func (log *Log) applyEntry(index uint64, value []byte) error {
+	switch {
+	case len(value) == 1 && value[0] == noopEntry:
+	case 17 <= len(value) && value[0] == commandEntry:
+		log.apply(index, value[17:])
+	default:
+		return &ErrInvalidLogEntry{Key: log.key(index)}
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	delete(log.decided, index)
+	log.applied++
+	return nil
+}
+
+func (log *Log) reserve() uint64 {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	index := log.next
+	log.next++
+	return index
+}
+
+func (log *Log) learn(index uint64, value []byte) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.applied <= index {
+		log.decided[index] = value
+	}
+	if log.next <= index {
+		log.next = index + 1
+	}
+}
+
+// The next entry to apply, and its value if it is known to be decided
+func (log *Log) lookup() (uint64, []byte, bool) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	value, ok := log.decided[log.applied]
+	return log.applied, value, ok
+}
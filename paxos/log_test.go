@@ -0,0 +1,119 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A log whose applied commands can be read back
+type testLog struct {
+	*Log
+	mutex   sync.Mutex
+	applied []string
+}
+
+func newTestLog(node *Node, prefix string) *testLog {
+	log := &testLog{}
+	log.Log = NewLog(node, prefix, func(index uint64, cmd []byte) {
+		log.mutex.Lock()
+		defer log.mutex.Unlock()
+		log.applied = append(log.applied, fmt.Sprintf("%d:%s", index, cmd))
+	})
+	return log
+}
+
+func (log *testLog) commands() []string {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return append([]string{}, log.applied...)
+}
+
+func TestLogAppend(t *testing.T) {
+	nodes := addTestNodes(NewNetwork(), 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	logs := []*testLog{}
+	for _, node := range nodes {
+		logs = append(logs, newTestLog(node, "log/"))
+	}
+	wg := sync.WaitGroup{}
+	for i, log := range logs {
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func(i, j int, log *testLog) {
+				defer wg.Done()
+				if _, err := log.Append(ctx, []byte(fmt.Sprintf("n%d-%d", i, j))); err != nil {
+					t.Error(err)
+				}
+			}(i, j, log)
+		}
+	}
+	wg.Wait()
+	for _, log := range logs {
+		if err := log.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := logs[0].commands()
+	if len(want) != 15 {
+		t.Fatalf("applied %v, want 15 commands", want)
+	}
+	for i, log := range logs {
+		if got := log.commands(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("n%d applied %v, but n0 applied %v", i, got, want)
+		}
+	}
+}
+
+// An index that was reserved but never written holds up every entry after it, until a no-op fills it
+func TestLogFillsGaps(t *testing.T) {
+	nodes := addTestNodes(NewNetwork(), 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log := newTestLog(nodes[0], "log/")
+	log.reserve() // As if an append gave up before its write reached any node
+	index, err := log.Append(ctx, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Fatalf("appended at %d, want 1", index)
+	}
+	if got, want := log.commands(), []string{"1:a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("applied %v, want %v", got, want)
+	}
+	value, err := nodes[1].Read(ctx, log.key(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(value, []byte{noopEntry}) {
+		t.Fatalf("got %q at the gap, want a no-op", value)
+	}
+
+	// Another node skips the no-op too
+	log2 := newTestLog(nodes[2], "log/")
+	if err := log2.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := log2.commands(), []string{"1:a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("applied %v, want %v", got, want)
+	}
+}
+
+func TestLogInvalidEntry(t *testing.T) {
+	nodes := addTestNodes(NewNetwork(), 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log := newTestLog(nodes[1], "log/")
+	if _, err := nodes[0].Write(ctx, log.key(0), []byte("not an entry")); err != nil {
+		t.Fatal(err)
+	}
+	err := log.Sync(ctx)
+	if _, ok := err.(*ErrInvalidLogEntry); !ok {
+		t.Fatalf("got %v, want ErrInvalidLogEntry", err)
+	}
+}
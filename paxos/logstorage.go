@@ -0,0 +1,404 @@
+package paxos
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	logSegmentSize    = 1 << 26 // Bytes in a segment past which writes go to a new one, and most in a record
+	logCompactMinSize = 1 << 22 // Bytes in every segment together before compacting is worth it
+	logHeaderSize     = 8       // Checksum and length in front of every record
+	logPut            = 1
+	logDelete         = 2
+)
+
+var logTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Where the value of a key is in the log
+type logLocation struct {
+	segment uint64
+	offset  int64
+	size    int
+}
+
+// The state behind log storage
+type logStorage struct {
+	dir      string
+	segments map[uint64]*os.File    // {segment: file} open for reading, and the last one for writing too
+	last     uint64                 // Segment that records are appended to
+	lastSize int64                  // Bytes in the last segment
+	size     int64                  // Bytes in every segment together
+	live     int64                  // Bytes the values would take with a record each, as after compacting
+	index    map[string]logLocation // {key: location} of every value
+	dirty    bool                   // Whether anything was appended since the last sync
+}
+
+// Durable storage in a write-ahead log of segment files, each a series of records with a checksum
+// in front. Every write appends a record, which syncing makes durable, and an index of where each
+// value is stays in memory. Opening storage reads every segment to build the index again, and drops
+// a record that a crash left half written at the end of the log, but fails with ErrCorruptStorage on
+// a bad record that good ones follow. Once mostly stale records fill the log, every value still
+// there is copied to new segments and the old ones go.
+func LogStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &logStorage{
+		dir:      dir,
+		segments: map[uint64]*os.File{},
+		index:    map[string]logLocation{},
+	}
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *logStorage) fname(segment uint64) string {
+	return path.Join(s.dir, fmt.Sprintf("%020d.log", segment))
+}
+
+// Read every segment in order to build the index
+func (s *logStorage) open() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	segments := []uint64{}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		if segment, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	if len(segments) == 0 {
+		return s.newSegment(1)
+	}
+	for i, segment := range segments {
+		file, err := os.OpenFile(s.fname(segment), os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		s.segments[segment] = file
+		size, err := s.replay(segment, file)
+		if err == io.ErrUnexpectedEOF && i == len(segments)-1 {
+			// A crash in the middle of the last write, which nobody heard back about
+			if err := file.Truncate(size); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		} else if err == io.ErrUnexpectedEOF {
+			return &ErrCorruptStorage{Path: s.fname(segment)}
+		} else if err != nil {
+			return err
+		}
+		s.size += size
+		s.last, s.lastSize = segment, size
+	}
+	return nil
+}
+
+// Apply every record in a segment to the index. Returns how many bytes hold whole records, with
+// io.ErrUnexpectedEOF if the bytes after them are a record that a crash left half written.
+func (s *logStorage) replay(segment uint64, file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		var header [logHeaderSize]byte
+		if _, err := io.ReadFull(reader, header[:]); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, io.ErrUnexpectedEOF
+		}
+		length := binary.BigEndian.Uint32(header[4:])
+		body := []byte(nil)
+		ok := length <= logSegmentSize
+		if ok {
+			body = make([]byte, length)
+			_, err := io.ReadFull(reader, body)
+			ok = err == nil && logChecksum(header[4:], body) == binary.BigEndian.Uint32(header[:4])
+		}
+		if !ok {
+			return offset, s.badRecord(segment, file, offset)
+		}
+		if !s.apply(segment, offset+logHeaderSize, body) {
+			return offset, &ErrCorruptStorage{Path: s.fname(segment)}
+		}
+		offset += logHeaderSize + int64(length)
+	}
+}
+
+// A record that does not check out at an offset is torn, as long as nothing after it does check out.
+// Otherwise a record that was synced went bad, and dropping everything after it would lose writes.
+func (s *logStorage) badRecord(segment uint64, file *os.File, offset int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	rest := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(rest, offset); err != nil {
+		return err
+	}
+	for i := 1; i+logHeaderSize <= len(rest); i++ {
+		length := int(binary.BigEndian.Uint32(rest[i+4:]))
+		end := i + logHeaderSize + length
+		if length < 1 || len(rest) < end {
+			continue
+		}
+		if logChecksum(rest[i+4:i+logHeaderSize], rest[i+logHeaderSize:end]) == binary.BigEndian.Uint32(rest[i:]) {
+			return &ErrCorruptStorage{Path: s.fname(segment)}
+		}
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Apply every put and delete in the body of a record at an offset, which has a good checksum
+func (s *logStorage) apply(segment uint64, offset int64, body []byte) bool {
+	r := &binaryReader{data: body}
+	for n := r.count(); 0 < n && r.err == nil; n-- {
+		kind, key := r.next(1), r.string()
+		if kind == nil || r.err != nil {
+			return false
+		}
+		s.remove(key)
+		if kind[0] == logDelete {
+			continue
+		}
+		size := int(r.uvarint())
+		valueOffset := offset + int64(len(body)-len(r.data))
+		if r.next(uint64(size)); r.err != nil {
+			return false
+		}
+		s.index[key] = logLocation{segment: segment, offset: valueOffset, size: size}
+		s.live += logRecordSize(key, size)
+	}
+	return r.err == nil && len(r.data) == 0
+}
+
+func (s *logStorage) remove(key string) {
+	if location, ok := s.index[key]; ok {
+		s.live -= logRecordSize(key, location.size)
+		delete(s.index, key)
+	}
+}
+
+// Bytes in a record that puts one key
+func logRecordSize(key string, size int) int64 {
+	varint := func(x int) int {
+		var b [binary.MaxVarintLen64]byte
+		return binary.PutUvarint(b[:], uint64(x))
+	}
+	return int64(logHeaderSize + varint(1) + 1 + varint(len(key)) + len(key) + varint(size) + size)
+}
+
+func logChecksum(length, body []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, logTable), logTable, body)
+}
+
+// Start a new segment and append to it from now on
+func (s *logStorage) newSegment(segment uint64) error {
+	file, err := os.OpenFile(s.fname(segment), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.segments[segment] = file
+	s.last, s.lastSize = segment, 0
+	return syncDir(s.dir)
+}
+
+// Append one record of every write, which is all of them or none once synced
+func (s *logStorage) append(writes map[string][]byte) error {
+	keys := []string{}
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w := &binaryWriter{}
+	w.uvarint(uint64(len(keys)))
+	for _, key := range keys {
+		if writes[key] == nil {
+			w.buf.WriteByte(logDelete)
+			w.string(key)
+		} else {
+			w.buf.WriteByte(logPut)
+			w.string(key)
+			w.uvarint(uint64(len(writes[key])))
+			w.buf.Write(writes[key])
+		}
+	}
+	body := w.buf.Bytes()
+	if logSegmentSize < len(body) {
+		return &ErrWriteTooLarge{Size: len(body)}
+	}
+	if s.segments == nil {
+		return &ErrClosed{}
+	}
+	if 0 < s.lastSize && logSegmentSize < s.lastSize+logHeaderSize+int64(len(body)) {
+		// Whatever is in the old segment has to be durable before anything in the new one is
+		if err := s.Sync(); err != nil {
+			return err
+		}
+		if err := s.newSegment(s.last + 1); err != nil {
+			return err
+		}
+	}
+	record := make([]byte, logHeaderSize, logHeaderSize+len(body))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[:4], logChecksum(record[4:], body))
+	record = append(record, body...)
+	file := s.segments[s.last]
+	if _, err := file.WriteAt(record, s.lastSize); err != nil {
+		// Cut off whatever part of it was written, so the next record follows the last whole one
+		file.Truncate(s.lastSize)
+		return err
+	}
+	s.dirty = true
+	if !s.apply(s.last, s.lastSize+logHeaderSize, body) {
+		return &ErrCorruptStorage{Path: s.fname(s.last)}
+	}
+	s.lastSize += int64(len(record))
+	s.size += int64(len(record))
+	if logCompactMinSize < s.size && 2*s.live < s.size {
+		return s.compact()
+	}
+	return nil
+}
+
+// Copy every value to new segments after the last one, then remove the old ones. A crash part way
+// leaves the old segments in place, and since the copies come later in the log they change nothing.
+func (s *logStorage) compact() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	old := []uint64{}
+	for segment := range s.segments {
+		old = append(old, segment)
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+	keys := []string{}
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := s.newSegment(s.last + 1); err != nil {
+		return err
+	}
+	s.size = 0
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		// Goes through append so the index points at the copies, without compacting again
+		if err := s.append(map[string][]byte{key: value}); err != nil {
+			return err
+		}
+	}
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	// Oldest first, so the segments left after a crash still end with the newest record of each key
+	for _, segment := range old {
+		s.segments[segment].Close()
+		delete(s.segments, segment)
+		if err := os.Remove(s.fname(segment)); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.dir)
+}
+
+func (s *logStorage) Get(key string) ([]byte, error) {
+	location, ok := s.index[key]
+	if !ok {
+		return nil, nil
+	}
+	if s.segments == nil {
+		return nil, &ErrClosed{}
+	}
+	value := make([]byte, location.size)
+	if _, err := s.segments[location.segment].ReadAt(value, location.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *logStorage) Put(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return s.append(map[string][]byte{key: value})
+}
+
+func (s *logStorage) Delete(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	return s.append(map[string][]byte{key: nil})
+}
+
+func (s *logStorage) Iterate(from, to string, f func(key string, value []byte) bool) error {
+	keys := []string{}
+	for key := range s.index {
+		if inRange(key, from, to) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	skipped := &ErrSkippedKeys{}
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if err != nil {
+			skipped.skip(key, err)
+			continue
+		}
+		if !f(key, value) {
+			break
+		}
+	}
+	return skipped.result()
+}
+
+func (s *logStorage) Batch(writes map[string][]byte) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	return s.append(writes)
+}
+
+func (s *logStorage) Sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.segments[s.last].Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *logStorage) Close() error {
+	err := s.Sync()
+	for _, file := range s.segments {
+		file.Close()
+	}
+	s.segments = nil
+	return err
+}
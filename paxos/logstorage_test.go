@@ -0,0 +1,236 @@
+package paxos
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openLog(t *testing.T, dir string) Storage {
+	s, err := LogStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// The segment files in a log storage dir, oldest first
+func logSegments(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".log") {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
+
+func TestLogStorageRecovery(t *testing.T) {
+	// Records for a, then b, then c, each of them logHeaderSize + 6 bytes
+	recordSize := int(logRecordSize("a", 1))
+	tests := []struct {
+		name    string
+		damage  func(data []byte) []byte
+		want    map[string]string
+		corrupt bool
+	}{
+		{"intact", func(data []byte) []byte { return data }, map[string]string{"a": "1", "b": "2", "c": "3"}, false},
+		{"torn header", func(data []byte) []byte { return data[:2*recordSize+3] }, map[string]string{"a": "1", "b": "2"}, false},
+		{"torn body", func(data []byte) []byte { return data[:len(data)-1] }, map[string]string{"a": "1", "b": "2"}, false},
+		{"bad checksum at the end", func(data []byte) []byte {
+			data[len(data)-1] ^= 1
+			return data
+		}, map[string]string{"a": "1", "b": "2"}, false},
+		{"zeros at the end", func(data []byte) []byte {
+			return append(data, make([]byte, 100)...)
+		}, map[string]string{"a": "1", "b": "2", "c": "3"}, false},
+		{"bad checksum in the middle", func(data []byte) []byte {
+			data[recordSize+logHeaderSize+4] ^= 1
+			return data
+		}, nil, true},
+		{"bad length in the middle", func(data []byte) []byte {
+			data[recordSize+4] = 0xff
+			return data
+		}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openLog(t, dir)
+			for i, key := range []string{"a", "b", "c"} {
+				if err := s.Put(key, []byte(fmt.Sprint(i+1))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fname := path.Join(dir, logSegments(t, dir)[0])
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 3*recordSize {
+				t.Fatalf("got %d bytes, want %d", len(data), 3*recordSize)
+			}
+			if err := ioutil.WriteFile(fname, test.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s, err = LogStorage(dir)
+			if test.corrupt {
+				if _, ok := err.(*ErrCorruptStorage); !ok {
+					t.Fatalf("got %v, want ErrCorruptStorage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := iterate(t, s, "", ""); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			// What was torn off is gone, so a new write after it survives the next reopen
+			if err := s.Put("d", []byte("4")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s = openLog(t, dir)
+			defer s.Close()
+			test.want["d"] = "4"
+			if got := iterate(t, s, "", ""); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v after reopening, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLogStorageRollover(t *testing.T) {
+	dir := t.TempDir()
+	s := openLog(t, dir)
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 1<<20)
+	}
+	// Past one segment, with every value live so nothing compacts
+	n := logSegmentSize>>20 + 2
+	for i := 0; i < n; i++ {
+		if err := s.Put(fmt.Sprintf("k%03d", i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segments := logSegments(t, dir); len(segments) != 2 {
+		t.Fatalf("got segments %v, want 2", segments)
+	}
+	check := func(s Storage, deleted int) {
+		for i := 0; i < n; i++ {
+			got, err := s.Get(fmt.Sprintf("k%03d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < deleted && got != nil {
+				t.Fatalf("k%03d is still there", i)
+			} else if deleted <= i && !bytes.Equal(got, value(i)) {
+				t.Fatalf("k%03d has the wrong value", i)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openLog(t, dir)
+	check(s, 0)
+
+	// Deleting most of them leaves the log mostly stale, which copies what is left to a new segment
+	deleted := n * 3 / 4
+	for i := 0; i < deleted; i++ {
+		if err := s.Delete(fmt.Sprintf("k%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := logSegments(t, dir)
+	if len(segments) != 1 || segments[0] <= "00000000000000000002.log" {
+		t.Fatalf("got segments %v, want one newer than the old ones", segments)
+	}
+	check(s, deleted)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openLog(t, dir)
+	defer s.Close()
+	check(s, deleted)
+	if err := s.Put("k000", value(0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A crash part way through compacting leaves the old segments and some copies, which opening reads in order
+func TestLogStorageCompactCrash(t *testing.T) {
+	dir := t.TempDir()
+	s := openLog(t, dir)
+	value := bytes.Repeat([]byte("x"), 1<<10)
+	for i := 0; i < 10; i++ {
+		if err := s.Put(fmt.Sprint(i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile(path.Join(dir, logSegments(t, dir)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = openLog(t, dir)
+	first := fmt.Sprintf("%020d.log", 1)
+	for logSegments(t, dir)[0] == first {
+		// Overwriting one key over and over compacts once the log passes its minimum size
+		if err := s.Put("big", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("0", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Bring back the first segment, as if the crash came before it was removed
+	if err := ioutil.WriteFile(path.Join(dir, first), old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = openLog(t, dir)
+	defer s.Close()
+	got, err := s.Get("0")
+	if err != nil || string(got) != "new" {
+		t.Fatalf("got %q, %v, want the newest value", got, err)
+	}
+	got, err = s.Get("big")
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestLogStorageClosed(t *testing.T) {
+	s := openLog(t, t.TempDir())
+	if err := s.Put("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b", []byte("2")); err == nil {
+		t.Fatal("wrote to closed storage")
+	}
+	if _, err := s.Get("a"); err == nil {
+		t.Fatal("read from closed storage")
+	}
+}
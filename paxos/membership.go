@@ -0,0 +1,452 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The members whose votes count, decided by Paxos on a reserved key of its own. A change adds or
+// removes one member and takes two epochs: a joint one where quorums need a majority of both the
+// old and new members, then one with only the new members. In between, every key is rewritten so
+// that a majority of the new members holds it.
+type configStruct struct {
+	Epoch      uint64   `json:"epoch"`
+	Members    []string `json:"members"`
+	OldMembers []string `json:"oldMembers,omitempty"` // Only set during the joint epoch
+}
+
+const configPrefix = reservedPrefix + "config/"
+
+// Where the configuration for an epoch is decided. Epoch 0 is every node added to the network and
+// is never written down.
+func configKey(epoch uint64) string {
+	return fmt.Sprintf("%s%020d", configPrefix, epoch)
+}
+
+func isConfigKey(key string) bool {
+	return strings.HasPrefix(key, configPrefix)
+}
+
+// Add a member whose vote counts toward quorums. Every node must be able to reach it through the
+// transport. Returns once the new member can be trusted with every key.
+func (node *Node) AddMember(ctx context.Context, id string) error {
+	return node.changeMembers(ctx, id, true)
+}
+
+// Remove a member, such as a dead host, so its vote no longer counts toward quorums
+func (node *Node) RemoveMember(ctx context.Context, id string) error {
+	return node.changeMembers(ctx, id, false)
+}
+
+// The members whose votes count, as far as this node knows
+func (node *Node) Members(ctx context.Context) ([]string, error) {
+	config, err := node.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return config.Members, nil
+}
+
+func (node *Node) changeMembers(ctx context.Context, id string, add bool) error {
+	if add && node.network.isLearner(id) {
+		return &ErrLearner{ID: id}
+	}
+	config, err := node.getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if config.OldMembers != nil {
+		// Another change never finished, so finish it first
+		if err := node.finishChange(ctx, config); err != nil {
+			return err
+		}
+		if config, err = node.getConfig(ctx); err != nil {
+			return err
+		}
+	}
+
+	members := []string{}
+	for _, id2 := range config.Members {
+		if id2 != id {
+			members = append(members, id2)
+		}
+	}
+	if add {
+		members = append(members, id)
+		sort.Strings(members)
+	}
+	if len(members) == len(config.Members) {
+		return nil // Nothing to change
+	}
+	if len(members) == 0 {
+		return &ErrNoMembers{}
+	}
+	if err := node.network.checkQuorums(members); err != nil {
+		return err
+	}
+
+	joint := &configStruct{
+		Epoch:      config.Epoch + 1,
+		Members:    members,
+		OldMembers: config.Members,
+	}
+	if err := node.proposeConfig(ctx, joint); err != nil {
+		return err
+	}
+	return node.finishChange(ctx, joint)
+}
+
+// Move every key over to the new members of a joint configuration, then leave the old ones behind
+func (node *Node) finishChange(ctx context.Context, joint *configStruct) error {
+	keys, err := node.keys(ctx, "", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := node.do(ctx, node.writeChan, &message{
+			Key:         key,
+			Ctx:         ctx,
+			RetryPolicy: node.getRetryPolicy(),
+			Repair:      true,
+		}); err != nil {
+			return err
+		}
+	}
+	return node.proposeConfig(ctx, &configStruct{
+		Epoch:   joint.Epoch + 1,
+		Members: joint.Members,
+	})
+}
+
+// Decide the configuration for its epoch. It is in effect on this node once this returns.
+func (node *Node) proposeConfig(ctx context.Context, config *configStruct) error {
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	value2, err := node.write(ctx, configKey(config.Epoch), value)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(value, value2) {
+		return &ErrMembershipChanged{Epoch: config.Epoch}
+	}
+	return nil
+}
+
+func (node *Node) getConfig(ctx context.Context) (*configStruct, error) {
+	configBytes, err := node.do(ctx, node.opChan, &message{
+		Type: configRequestType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &configStruct{}
+	return config, json.Unmarshal(configBytes, config)
+}
+
+// Operations that are neither reads nor writes
+func (loop *nodeLoop) handleOp(msg *message) {
+	switch msg.Type {
+	case configRequestType:
+		config := *loop.config
+		if config.Epoch == 0 {
+			config.Members = loop.network.firstMembers()
+		}
+		configBytes, err := json.Marshal(&config)
+		respond(msg, configBytes, err)
+	case keysRequestType:
+		// Every key that could have been decided is held by a majority of the old members
+		if !loop.canListKeys() {
+			respond(msg, nil, &ErrCannotListKeys{})
+			return
+		}
+		loop.msgMap[msg.OpID] = msg
+		loop.startKeys(msg)
+	default:
+		respond(msg, nil, nil)
+		loop.network.stderrLogger.Printf("Illegal operation type: %d", msg.Type)
+	}
+}
+
+// Ask the old members which keys they have. Any phase 1 quorum of them holds every key that could
+// have been decided.
+func (loop *nodeLoop) startKeys(msg *message) {
+	old := map[string]struct{}{}
+	for _, id := range loop.oldMembers() {
+		old[id] = struct{}{}
+	}
+	loop.keysMap[msg.OpID] = map[string]struct{}{}
+	loop.keysRespondedMap[msg.OpID] = map[string]struct{}{}
+	delete(loop.keysUntilMap, msg.OpID)
+	request := &message{
+		Type:  keysRequestType,
+		OpID:  msg.OpID,
+		From:  msg.From,
+		To:    msg.To,
+		Limit: msg.Limit,
+	}
+	loop.keysWaitingMap[msg.OpID] = loop.multicast(old, request)
+	loop.expect(request)
+}
+
+func (loop *nodeLoop) loadConfig() {
+	loop.config = &configStruct{}
+	for epoch := loop.meta.Epoch; 0 < epoch; epoch-- {
+		state, err := loop.getState(configKey(epoch))
+		if err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+		if state.Final {
+			if err := json.Unmarshal(state.Value, loop.config); err != nil {
+				loop.network.stderrLogger.Print(err)
+			}
+			return
+		}
+	}
+}
+
+// Every set of members that needs a quorum of its own. There are two during a joint epoch, with the
+// old members last.
+func (loop *nodeLoop) quorumSets() [][]string {
+	switch {
+	case loop.config.Epoch == 0:
+		return [][]string{loop.network.firstMembers()}
+	case loop.config.OldMembers != nil:
+		return [][]string{loop.config.Members, loop.config.OldMembers}
+	default:
+		return [][]string{loop.config.Members}
+	}
+}
+
+// The members before the change in progress, or the current ones when nothing is changing
+func (loop *nodeLoop) oldMembers() []string {
+	sets := loop.quorumSets()
+	return sets[len(sets)-1]
+}
+
+// Every node whose vote counts
+func (loop *nodeLoop) members() map[string]struct{} {
+	ids := map[string]struct{}{}
+	for _, members := range loop.quorumSets() {
+		for _, id := range members {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// Refuse requests from nodes with an old configuration, since their quorums might not overlap with
+// the current ones. Catch up when this node is the one behind.
+func (loop *nodeLoop) checkEpoch(msg *message) bool {
+	if msg.Type == finalType {
+		return true
+	}
+	if loop.config.Epoch < msg.Epoch {
+		if loop.meta.Epoch < msg.Epoch {
+			loop.meta.Epoch = msg.Epoch
+			if err := loop.putMeta(); err != nil {
+				loop.network.stderrLogger.Print(err)
+				return false
+			}
+		}
+		// The sender refuses this, and answers with its configuration
+		loop.send(msg.Sender, &message{
+			Type: readRequestType,
+			Key:  configKey(msg.Epoch),
+		})
+	}
+	switch msg.Type {
+	case readRequestType, write1RequestType, write2RequestType, leaderPrepareType, heartbeatType,
+		forwardType, keysRequestType, installType, fastRequestType:
+		if msg.Epoch < loop.meta.Epoch {
+			loop.sendConfig(msg.Sender)
+			return false
+		}
+	}
+	return true
+}
+
+func (loop *nodeLoop) sendConfig(to string) {
+	if loop.config.Epoch == 0 {
+		return
+	}
+	key := configKey(loop.config.Epoch)
+	state, err := loop.getState(key)
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	loop.send(to, &message{
+		Type:  finalType,
+		Key:   key,
+		Value: state.Value,
+	})
+}
+
+// A configuration was decided, start using it if it is newer
+func (loop *nodeLoop) adoptConfig(value []byte) {
+	config := &configStruct{}
+	if err := json.Unmarshal(value, config); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	if config.Epoch <= loop.config.Epoch {
+		return
+	}
+	loop.config = config
+	if loop.meta.Epoch < config.Epoch {
+		loop.meta.Epoch = config.Epoch
+		if err := loop.putMeta(); err != nil {
+			loop.network.stderrLogger.Print(err)
+		}
+	}
+
+	// Responses so far were counted against the old quorums, so start over
+	for opID, msg := range loop.msgMap {
+		_, inFast := loop.fastWaitingMap[opID]
+		_, inFetch := loop.fetchMap[opID]
+		inRound := inFast || inFetch || 0 < len(loop.write1WaitingMap[opID])+len(loop.write2WaitingMap[opID])
+		delete(loop.write1WaitingMap, opID)
+		delete(loop.write2WaitingMap, opID)
+		delete(loop.fastWaitingMap, opID)
+		delete(loop.fetchMap, opID)
+		if inRound && (loop.leader == nil || msg.Repair) {
+			msg := msg
+			loop.life.goroutine(func() {
+				loop.rewrite(msg)
+			})
+		}
+		if _, ok := loop.readWaitingMap[opID]; ok {
+			loop.startRead(msg)
+		}
+		if _, ok := loop.keysWaitingMap[opID]; ok {
+			loop.startKeys(msg)
+		}
+		if _, ok := loop.installWaitingMap[opID]; ok {
+			delete(loop.installWaitingMap, opID)
+			loop.install(opID, msg.Key, loop.proposedValueMap[opID])
+		}
+	}
+	if leader := loop.leader; leader != nil {
+		if leader.active {
+			// Phase 1 was done with the old quorums
+			loop.stepDown()
+			leader.deadline = time.Now()
+		} else if !leader.campaignN.isZero() {
+			loop.campaign()
+		}
+	}
+}
+
+func (loop *nodeLoop) handleKeysRequest(msg *message) {
+	keys := []string{}
+	err := loop.iterate(msg.From, msg.To, func(key string, value []byte) bool {
+		if !isReserved(key) {
+			keys = append(keys, key)
+		}
+		return msg.Limit == 0 || len(keys) < msg.Limit
+	})
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	loop.send(msg.Sender, &message{
+		Type: keysResponseType,
+		OpID: msg.OpID,
+		Keys: keys,
+	})
+}
+
+func (loop *nodeLoop) handleKeysResponse(msg *message) {
+	waitingMap, ok := loop.keysWaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	if _, ok := waitingMap[msg.Sender]; !ok {
+		return
+	}
+	delete(waitingMap, msg.Sender)
+	keysMap := loop.keysMap[msg.OpID]
+	for _, key := range msg.Keys {
+		keysMap[key] = struct{}{}
+	}
+	if request, ok := loop.msgMap[msg.OpID]; ok && 0 < request.Limit && request.Limit <= len(msg.Keys) {
+		// The member may have more keys after its last one, which the others cannot make up for
+		last := msg.Keys[len(msg.Keys)-1]
+		if until, ok := loop.keysUntilMap[msg.OpID]; !ok || last < until {
+			loop.keysUntilMap[msg.OpID] = last
+		}
+	}
+	respondedMap := loop.keysRespondedMap[msg.OpID]
+	respondedMap[msg.Sender] = struct{}{}
+	if !loop.network.isQuorum(loop.oldMembers(), respondedMap, phase1) {
+		return
+	}
+	keys := []jsonKey{}
+	until, limited := loop.keysUntilMap[msg.OpID]
+	for key := range keysMap {
+		if !limited || key <= until {
+			keys = append(keys, jsonKey(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	keysBytes, err := json.Marshal(keys)
+	loop.finish(msg.OpID, keysBytes, err)
+}
+
+// A key being repaired is already final somewhere, so make sure a quorum of members has it
+func (loop *nodeLoop) install(opID string, key string, value []byte) {
+	if _, ok := loop.installWaitingMap[opID]; ok {
+		return
+	}
+	delete(loop.write1WaitingMap, opID)
+	delete(loop.write2WaitingMap, opID)
+	loop.proposedValueMap[opID] = value
+	request := &message{
+		Type:  installType,
+		OpID:  opID,
+		Key:   key,
+		Value: value,
+	}
+	loop.installWaitingMap[opID] = loop.broadcast(request)
+	loop.expect(request)
+}
+
+func (loop *nodeLoop) handleInstall(msg *message, state *stateStruct) {
+	if !state.Final {
+		if err := loop.putState(msg.Key, &stateStruct{
+			Value: msg.Value,
+			Final: true,
+		}); err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+		if loop.leader != nil {
+			loop.forgetAccepted(msg.Key)
+		}
+		loop.learned(msg.Key, msg.Value)
+	}
+	loop.send(msg.Sender, &message{
+		Type: installResponseType,
+		OpID: msg.OpID,
+		Key:  msg.Key,
+	})
+}
+
+func (loop *nodeLoop) handleInstallResponse(msg *message) {
+	waitingMap, ok := loop.installWaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	delete(waitingMap, msg.Sender)
+	if loop.quorumResponded(waitingMap, phase2) {
+		loop.finish(msg.OpID, loop.proposedValueMap[msg.OpID], nil)
+	}
+}
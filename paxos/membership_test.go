@@ -0,0 +1,89 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMembershipChange(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for k := 0; k < 10; k++ {
+		if _, err := nodes[k%3].Write(ctx, fmt.Sprint("k", k), []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new node does not vote until it is added, and then knows every key
+	nodes = append(nodes, network.AddNewNode("n3", MemoryStorage()))
+	if err := nodes[0].AddMember(ctx, "n3"); err != nil {
+		t.Fatal(err)
+	}
+	for i, node := range nodes {
+		members, err := node.Members(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"n0", "n1", "n2", "n3"}; !reflect.DeepEqual(members, want) {
+			t.Fatalf("n%d has members %v, want %v", i, members, want)
+		}
+	}
+	for k := 0; k < 10; k++ {
+		value, err := nodes[3].Read(ctx, fmt.Sprint("k", k))
+		if err != nil || string(value) != "before" {
+			t.Fatalf("n3 read %q, %v for k%d", value, err, k)
+		}
+	}
+
+	if err := nodes[1].RemoveMember(ctx, "n0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{1, 2, 3} {
+		members, err := nodes[i].Members(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"n1", "n2", "n3"}; !reflect.DeepEqual(members, want) {
+			t.Fatalf("n%d has members %v, want %v", i, members, want)
+		}
+	}
+	for k := 0; k < 10; k++ {
+		if value, err := nodes[1].Read(ctx, fmt.Sprint("k", k)); err != nil || string(value) != "before" {
+			t.Fatalf("n1 read %q, %v for k%d", value, err, k)
+		}
+		if value, err := nodes[2].Write(ctx, fmt.Sprint("after", k), []byte("after")); err != nil || string(value) != "after" {
+			t.Fatalf("n2 wrote %q, %v for after%d", value, err, k)
+		}
+	}
+
+	// Neither a removed node nor one that is down out of three is needed
+	for _, i := range []int{0, 1} {
+		if err := nodes[i].Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := nodes[2].Write(ctx, "closed", []byte("closed")); err != nil || string(value) != "closed" {
+		t.Fatalf("n2 wrote %q, %v", value, err)
+	}
+
+	// Removing a node that is not a member changes nothing, and removing every member is refused
+	if err := nodes[2].RemoveMember(ctx, "n0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"n1", "n2"} {
+		if err := nodes[3].RemoveMember(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[3].RemoveMember(ctx, "n3"); err == nil {
+		t.Fatal("removed the last member")
+	} else if _, ok := err.(*ErrNoMembers); !ok {
+		t.Fatalf("got %v, want ErrNoMembers", err)
+	}
+}
@@ -1,9 +1,11 @@
 package paxos
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"unicode/utf8"
 )
 
 const (
@@ -16,25 +18,64 @@ const (
 	write2ResponseType
 	write2NackType
 	finalType
+	leaderPrepareType
+	leaderPromiseType
+	leaderNackType
+	heartbeatType
+	forwardType
+	keysRequestType
+	keysResponseType
+	installType
+	installResponseType
+	fastRequestType
+	fastResponseType
+	leaseGrantType
+	valueRequestType
+	valueResponseType
+	batchType
+	syncRequestType
+	syncResponseType
+	finalsRequestType
+	configRequestType // Only between a node and its own goroutine
 )
 
-func encodeMessage(msg *message) []byte {
-	data, _ := json.Marshal(msg)
-	return data
-}
-
 type message struct {
 	Type      int    `json:"type"`
 	Sender    string `json:"sender"`
 	OpID      string `json:"opId"`
-	Key       uint64 `json:"key"`
+	Key       string `json:"key"`
 	Value     []byte `json:"value"`
-	N         uint64 `json:"n"`
-	AcceptedN uint64 `json:"acceptedN"`
+	Hash      string `json:"hash,omitempty"` // Of the value, from a witness that does not keep it
+	N         ballot `json:"n"`
+	AcceptedN ballot `json:"acceptedN"`
+	PromisedN ballot `json:"promisedN"`
+	Epoch     uint64 `json:"epoch"` // Of the sender's configuration
+
+	// Digests of final keys for anti-entropy, one for each bucket
+	Digests []string `json:"digests,omitempty"`
+
+	// Messages sent together in one envelope
+	Batch []json.RawMessage `json:"batch,omitempty"`
+
+	// Accepted values a node reports when promising a leader
+	Entries []*message `json:"entries,omitempty"`
+
+	// Keys a node has state for, while changing members, scanning or promising a leader that reads
+	// with leases
+	Keys    []string `json:"keys,omitempty"`
+	AllKeys bool     `json:"allKeys,omitempty"` // Keys lists every key, rather than the node not being able to
+	From    string   `json:"from,omitempty"`    // First key to list
+	To      string   `json:"to,omitempty"`      // Key to list up to, but not including, or empty for no end
+	Limit   int      `json:"limit,omitempty"`   // Most keys to list, zero for no limit
 
 	// For reading/writing
-	ResponseChan chan<- []byte `json:"-"`
-	ErrChan      chan<- error  `json:"-"`
+	Ctx          context.Context `json:"-"`
+	RetryPolicy  *RetryPolicy    `json:"-"`
+	Attempts     int             `json:"-"` // Rounds that were beaten by another proposer
+	Repair       bool            `json:"-"` // Rewrite whatever was accepted rather than a new value
+	ForRead      bool            `json:"-"` // A repair by a read, which gives up rather than retry
+	ResponseChan chan<- []byte   `json:"-"`
+	ErrChan      chan<- error    `json:"-"`
 }
 
 func newOpID() string {
@@ -42,3 +83,76 @@ func newOpID() string {
 	rand.Read(bytes)
 	return fmt.Sprintf("%x", bytes)
 }
+
+// JSON strings are UTF-8, which would mangle keys that are not, so those go as base64 instead. A
+// message whose keys are all UTF-8 encodes the same as ever.
+func (msg *message) MarshalJSON() ([]byte, error) {
+	keysUTF8 := utf8.ValidString(msg.Key) && utf8.ValidString(msg.From) && utf8.ValidString(msg.To)
+	for _, key := range msg.Keys {
+		keysUTF8 = keysUTF8 && utf8.ValidString(key)
+	}
+	if keysUTF8 {
+		return json.Marshal((*plainMessage)(msg))
+	}
+	return json.Marshal(newMessageJSON(msg))
+}
+
+func (msg *message) UnmarshalJSON(data []byte) error {
+	msgJSON := newMessageJSON(msg)
+	if err := json.Unmarshal(data, msgJSON); err != nil {
+		return err
+	}
+	msg.Key, msg.From, msg.To = string(msgJSON.Key), string(msgJSON.From), string(msgJSON.To)
+	msg.Keys = nil
+	for _, key := range msgJSON.Keys {
+		msg.Keys = append(msg.Keys, string(key))
+	}
+	return nil
+}
+
+// A message without its own JSON methods, so encoding/json handles it field by field
+type plainMessage message
+
+// A message with its keys in fields that keep any bytes
+type messageJSON struct {
+	*plainMessage
+	Key  jsonKey   `json:"key"`
+	Keys []jsonKey `json:"keys,omitempty"`
+	From jsonKey   `json:"from,omitempty"`
+	To   jsonKey   `json:"to,omitempty"`
+}
+
+func newMessageJSON(msg *message) *messageJSON {
+	msgJSON := &messageJSON{
+		plainMessage: (*plainMessage)(msg),
+		Key:          jsonKey(msg.Key),
+		From:         jsonKey(msg.From),
+		To:           jsonKey(msg.To),
+	}
+	for _, key := range msg.Keys {
+		msgJSON.Keys = append(msgJSON.Keys, jsonKey(key))
+	}
+	return msgJSON
+}
+
+// A key in JSON, a string if it is UTF-8 and {"base64": "..."} if not
+type jsonKey string
+
+func (key jsonKey) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(string(key)) {
+		return json.Marshal(string(key))
+	}
+	return json.Marshal(map[string][]byte{"base64": []byte(key)})
+}
+
+func (key *jsonKey) UnmarshalJSON(data []byte) error {
+	if 0 < len(data) && data[0] == '{' {
+		keyBytes := map[string][]byte{}
+		if err := json.Unmarshal(data, &keyBytes); err != nil {
+			return err
+		}
+		*key = jsonKey(keyBytes["base64"])
+		return nil
+	}
+	return json.Unmarshal(data, (*string)(key))
+}
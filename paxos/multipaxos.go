@@ -0,0 +1,466 @@
+package paxos
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	heartbeatInterval = 100 * time.Millisecond
+	electionTimeout   = time.Second // Randomized up to double this so that campaigns rarely collide
+)
+
+// What a node knows about the leader in Multi-Paxos mode
+type leaderState struct {
+	id         string              // Current leader, empty when unknown
+	n          ballot              // Ballot of the current leader
+	active     bool                // This node is the leader and has finished phase 1
+	deadline   time.Time           // Campaign if no heartbeat arrives before this
+	seenRound  uint64              // Highest round seen from other leaders
+	campaignN  ballot              // Ballot this node is campaigning with, zero when not campaigning
+	waitingMap map[string]struct{} // {sender: null} still waiting on a promise
+	recovered  map[string]*message // {key: entry} highest accepted value that was promised
+	proposals  map[string][]string // {key: [opId]} writes for keys this leader is deciding
+	forwarded  map[string]*message // {opId: message} writes sent to the leader
+	queued     map[string]*message // {opId: message} writes waiting for a leader
+
+	leaseUntil  time.Time              // This node can answer reads itself until then
+	leaseRounds map[string]*leaseRound // {opId: round} heartbeats waiting on lease grants
+	listedKeys  map[string]struct{}    // {key: null} other nodes have state for, from their promises
+	keysUnknown bool                   // Some promise could not list its keys
+}
+
+func newLeaderState() *leaderState {
+	return &leaderState{
+		deadline:  time.Now().Add(randomElectionTimeout()),
+		proposals: map[string][]string{},
+		forwarded: map[string]*message{},
+		queued:    map[string]*message{},
+
+		leaseRounds: map[string]*leaseRound{},
+		listedKeys:  map[string]struct{}{},
+	}
+}
+
+func randomElectionTimeout() time.Duration {
+	return electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+// Send a write down the Multi-Paxos path. The leader skips straight to phase 2, everyone else
+// forwards to the leader or holds on to the write until there is one.
+func (loop *nodeLoop) leadWrite(msg *message) {
+	leader := loop.leader
+	switch {
+	case leader.active:
+		// Only one value per key can be proposed with a ballot, so later writes wait on the first
+		if opIDs, ok := leader.proposals[msg.Key]; ok {
+			leader.proposals[msg.Key] = append(opIDs, msg.OpID)
+			return
+		}
+		leader.proposals[msg.Key] = []string{msg.OpID}
+		loop.startPhase2(msg.OpID, msg.Key, leader.n, msg.Value)
+	case leader.id != "" && leader.id != msg.Sender:
+		leader.forwarded[msg.OpID] = msg
+		request := &message{
+			Type:  forwardType,
+			OpID:  msg.OpID,
+			Key:   msg.Key,
+			Value: msg.Value,
+		}
+		loop.send(leader.id, request)
+		loop.expect(request)
+	default:
+		leader.queued[msg.OpID] = msg
+	}
+}
+
+// Send writes that are waiting on a leader, or that went to an old one, to the current leader
+func (loop *nodeLoop) redispatch() {
+	leader := loop.leader
+	msgs := []*message{}
+	for opID, msg := range leader.forwarded {
+		msgs = append(msgs, msg)
+		delete(leader.forwarded, opID)
+	}
+	for opID, msg := range leader.queued {
+		msgs = append(msgs, msg)
+		delete(leader.queued, opID)
+	}
+	for _, msg := range msgs {
+		loop.leadWrite(msg)
+	}
+}
+
+func (loop *nodeLoop) tick() {
+	leader := loop.leader
+	if leader.active {
+		opID := newOpID()
+		if loop.network.leasesOn() {
+			loop.startLease(opID)
+		}
+		// Learners listen too, so they know where to forward writes
+		loop.multicast(loop.withLearners(loop.members()), &message{
+			Type: heartbeatType,
+			OpID: opID,
+			N:    leader.n,
+		})
+		return
+	}
+	if !loop.learner && !loop.witness && time.Now().After(leader.deadline) {
+		loop.campaign()
+	}
+}
+
+// Try to become the leader by running phase 1 for every key at once
+func (loop *nodeLoop) campaign() {
+	leader := loop.leader
+	leader.id = ""
+	leader.deadline = time.Now().Add(randomElectionTimeout())
+	for _, round := range []uint64{leader.seenRound, leader.n.Round, loop.meta.PromisedN.Round} {
+		if loop.meta.N < round {
+			loop.meta.N = round
+		}
+	}
+	loop.meta.N++
+	if err := loop.putMeta(); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	leader.campaignN = ballot{Round: loop.meta.N, NodeID: loop.id}
+	leader.recovered = map[string]*message{}
+	leader.listedKeys = map[string]struct{}{}
+	leader.keysUnknown = false
+	leader.waitingMap = loop.broadcast(&message{
+		Type: leaderPrepareType,
+		N:    leader.campaignN,
+	})
+}
+
+func (loop *nodeLoop) stepDown() {
+	leader := loop.leader
+	leader.active = false
+	leader.id = ""
+	leader.leaseUntil = time.Time{}
+	leader.leaseRounds = map[string]*leaseRound{}
+	// Hold on to everything in progress until there is a new leader
+	for key, opIDs := range leader.proposals {
+		for _, opID := range opIDs {
+			if msg, ok := loop.msgMap[opID]; ok {
+				leader.queued[opID] = msg
+			}
+		}
+		delete(leader.proposals, key)
+	}
+}
+
+// A key was decided, so answer every write that was waiting on it
+func (loop *nodeLoop) finishProposals(key string, value []byte) {
+	for _, opID := range loop.leader.proposals[key] {
+		if msg, ok := loop.msgMap[opID]; ok && msg.ResponseChan == nil && msg.Sender != "" {
+			// Forwarded from another node
+			loop.send(msg.Sender, &message{
+				Type:  finalType,
+				OpID:  opID,
+				Key:   key,
+				Value: value,
+			})
+		}
+		loop.finish(opID, value, nil)
+	}
+	delete(loop.leader.proposals, key)
+}
+
+func (loop *nodeLoop) handleLeaderPrepare(msg *message) {
+	if loop.leader == nil {
+		loop.network.stderrLogger.Printf("%s is not in Multi-Paxos mode", loop.id)
+		return
+	}
+	if !loop.meta.PromisedN.less(msg.N) || loop.leaseRefusesPrepare(msg.N) {
+		loop.send(msg.Sender, &message{
+			Type:      leaderNackType,
+			N:         msg.N,
+			PromisedN: loop.meta.PromisedN,
+		})
+		return
+	}
+
+	// Promise for every key, and report everything accepted. Final keys are reported too, since
+	// this may be the only node in the new leader's quorum that accepted a value that was chosen.
+	loop.meta.PromisedN = msg.N
+	loop.meta.LeaseBlocked = false
+	if err := loop.putMeta(); err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	entries := []*message{}
+	keys := []string{}
+	for key := range loop.meta.Accepted {
+		keys = append(keys, key)
+	}
+	if err := loop.loadFinals(); err == nil {
+		for key := range loop.finals {
+			if !loop.meta.Accepted[key] {
+				keys = append(keys, key)
+			}
+		}
+	} else if _, ok := err.(*ErrCannotListKeys); !ok {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	for _, key := range keys {
+		state, err := loop.getState(key)
+		if err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+		switch {
+		case state.Final:
+			entries = append(entries, &message{
+				Type:  finalType,
+				Key:   key,
+				Value: state.Value,
+				Hash:  state.Hash,
+			})
+		case !state.AcceptedN.isZero():
+			entries = append(entries, &message{
+				Key:       key,
+				AcceptedN: state.AcceptedN,
+				Value:     state.Value,
+				Hash:      state.Hash,
+			})
+		}
+	}
+	// A leader that reads with leases has to know about every key, even ones with no value
+	keys, allKeys := []string(nil), false
+	if loop.network.leasesOn() {
+		if keys2, err := loop.listKeys(); err != nil {
+			loop.network.stderrLogger.Print(err)
+		} else {
+			keys, allKeys = keys2, true
+		}
+	}
+	if msg.Sender != loop.id {
+		// Someone else is taking over, give them time to finish
+		loop.stepDown()
+		loop.leader.deadline = time.Now().Add(randomElectionTimeout())
+	}
+	loop.send(msg.Sender, &message{
+		Type:    leaderPromiseType,
+		N:       msg.N,
+		Entries: entries,
+		Keys:    keys,
+		AllKeys: allKeys,
+	})
+}
+
+func (loop *nodeLoop) handleLeaderPromise(msg *message) {
+	leader := loop.leader
+	if leader == nil || leader.waitingMap == nil || leader.campaignN != msg.N {
+		return
+	}
+	if _, ok := leader.waitingMap[msg.Sender]; !ok {
+		return
+	}
+	delete(leader.waitingMap, msg.Sender)
+	for _, entry := range msg.Entries {
+		if entry2, ok := leader.recovered[entry.Key]; !ok || recoversMore(entry, entry2) {
+			leader.recovered[entry.Key] = entry
+		}
+	}
+	for _, key := range msg.Keys {
+		leader.listedKeys[key] = struct{}{}
+	}
+	if !msg.AllKeys {
+		leader.keysUnknown = true
+	}
+	if !loop.quorumResponded(leader.waitingMap, phase1) {
+		return
+	}
+
+	// Phase 1 is done for every key, so lead
+	leader.active = true
+	leader.id = loop.id
+	leader.n = leader.campaignN
+	leader.campaignN = ballot{}
+	leader.waitingMap = nil
+	loop.broadcast(&message{
+		Type: heartbeatType,
+		N:    leader.n,
+	})
+	// Finish whatever earlier leaders left accepted but not final, and learn what is final already
+	for key, entry := range leader.recovered {
+		opID := newOpID()
+		leader.proposals[key] = []string{opID}
+		if entry.Type == finalType {
+			loop.recoverFinal(opID, entry)
+			continue
+		}
+		if entry.Value == nil {
+			loop.fetchRecovered(opID, entry)
+			continue
+		}
+		loop.startPhase2(opID, key, leader.n, entry.Value)
+	}
+	leader.recovered = nil
+	loop.redispatch()
+}
+
+// Whether a promised entry says more about its key than the one recovered so far. A final value was
+// chosen, so it beats anything that was only accepted.
+func recoversMore(entry, entry2 *message) bool {
+	if final, final2 := entry.Type == finalType, entry2.Type == finalType; final != final2 {
+		return final
+	}
+	return entry2.AcceptedN.less(entry.AcceptedN) || entry2.AcceptedN == entry.AcceptedN && entry2.Value == nil
+}
+
+// Only witnesses reported a value to finish, so find it elsewhere. If no other member has it, it
+// was never chosen and the writes waiting on the key can go ahead.
+func (loop *nodeLoop) fetchRecovered(opID string, entry *message) {
+	leader, n := loop.leader, loop.leader.n
+	loop.fetch(opID, entry.Key, entry.Hash, func(value []byte) {
+		if !leader.active || leader.n != n {
+			return
+		}
+		if value != nil {
+			loop.startPhase2(opID, entry.Key, n, value)
+			return
+		}
+		opIDs := leader.proposals[entry.Key][1:]
+		delete(leader.proposals, entry.Key)
+		for _, opID2 := range opIDs {
+			if msg, ok := loop.msgMap[opID2]; ok {
+				loop.leadWrite(msg)
+			}
+		}
+	})
+}
+
+// A promise reported a key as final, so take its value as decided rather than propose anything.
+// Writes waiting on the key get the final value.
+func (loop *nodeLoop) recoverFinal(opID string, entry *message) {
+	if entry.Value != nil {
+		loop.handleMessage(&message{Type: finalType, Sender: loop.id, OpID: opID, Key: entry.Key, Value: entry.Value})
+		return
+	}
+	// Only witnesses reported it, which keep just the hash
+	leader, n := loop.leader, loop.leader.n
+	loop.fetch(opID, entry.Key, entry.Hash, func(value []byte) {
+		if !leader.active || leader.n != n {
+			return
+		}
+		if value == nil {
+			loop.network.stderrLogger.Printf("%s cannot find the final value of key %q", loop.id, entry.Key)
+			return
+		}
+		loop.handleMessage(&message{Type: finalType, Sender: loop.id, OpID: opID, Key: entry.Key, Value: value})
+	})
+}
+
+func (loop *nodeLoop) handleLeaderNack(msg *message) {
+	leader := loop.leader
+	if leader == nil || leader.campaignN != msg.N {
+		return
+	}
+	// Someone has a higher ballot, let them lead
+	if leader.seenRound < msg.PromisedN.Round {
+		leader.seenRound = msg.PromisedN.Round
+	}
+	leader.campaignN = ballot{}
+	leader.waitingMap = nil
+	leader.recovered = nil
+}
+
+func (loop *nodeLoop) handleLeadWriteNack(msg *message) {
+	waitingMap, ok := loop.write2WaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	if _, ok := waitingMap[msg.N]; !ok {
+		return
+	}
+	delete(waitingMap, msg.N)
+	leader := loop.leader
+	if leader.seenRound < msg.PromisedN.Round {
+		leader.seenRound = msg.PromisedN.Round
+	}
+	if leader.active && leader.n == msg.N {
+		// A node promised a higher ballot, so this node is no longer the leader
+		loop.stepDown()
+		return
+	}
+	if msg2, ok := loop.msgMap[msg.OpID]; ok {
+		loop.leadWrite(msg2)
+	}
+}
+
+func (loop *nodeLoop) handleHeartbeat(msg *message) {
+	leader := loop.leader
+	if leader == nil || msg.N.less(leader.n) || msg.N.less(loop.meta.PromisedN) {
+		return // From an old leader
+	}
+	if leader.active {
+		if leader.n == msg.N {
+			loop.grantLease(msg)
+			return // From this node
+		}
+		loop.stepDown()
+	}
+	if leader.campaignN.less(msg.N) {
+		leader.campaignN = ballot{}
+		leader.waitingMap = nil
+		leader.recovered = nil
+	}
+	changed := leader.id != msg.Sender
+	leader.id = msg.Sender
+	leader.n = msg.N
+	leader.deadline = time.Now().Add(randomElectionTimeout())
+	if changed {
+		loop.redispatch()
+	}
+	loop.grantLease(msg)
+}
+
+// A write forwarded by another node that thinks this node is the leader
+func (loop *nodeLoop) handleForward(msg *message) {
+	if loop.leader == nil {
+		loop.network.stderrLogger.Printf("%s is not in Multi-Paxos mode", loop.id)
+		return
+	}
+	if _, ok := loop.msgMap[msg.OpID]; ok {
+		return // Already working on it
+	}
+	msg2 := &message{
+		Sender: msg.Sender,
+		OpID:   msg.OpID,
+		Key:    msg.Key,
+		Value:  msg.Value,
+	}
+	loop.msgMap[msg.OpID] = msg2
+	loop.leadWrite(msg2)
+}
+
+// Keep track of keys with accepted values that are not final, since a new leader has to finish
+// them. This goes in the same batch as the accepted value.
+func (loop *nodeLoop) rememberAccepted(key string) error {
+	if loop.meta.Accepted[key] {
+		return nil
+	}
+	if loop.meta.Accepted == nil {
+		loop.meta.Accepted = map[string]bool{}
+	}
+	loop.meta.Accepted[key] = true
+	return loop.putMeta()
+}
+
+// Saved in the same batch as the key's final value. Storage that cannot list its keys keeps the key
+// in meta instead, since that is how its promises report final keys.
+func (loop *nodeLoop) forgetAccepted(key string) {
+	if !loop.meta.Accepted[key] || loop.loadFinals() != nil {
+		return
+	}
+	delete(loop.meta.Accepted, key)
+	if err := loop.putMeta(); err != nil {
+		loop.network.stderrLogger.Print(err)
+	}
+}
@@ -3,27 +3,75 @@ package paxos
 import (
 	"io/ioutil"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
 func NewNetwork() *Network {
 	return &Network{
-		channels:     map[string]chan<- []byte{},
+		nodes:        map[string]*Node{},
+		members:      map[string]struct{}{},
+		learners:     map[string]struct{}{},
+		witnesses:    map[string]struct{}{},
+		weights:      map[string]int{},
 		stdoutLogger: log.New(ioutil.Discard, "", log.LstdFlags),
 		stderrLogger: log.New(ioutil.Discard, "", log.LstdFlags),
+		resendAfter:  defaultResendTimeout,
+		codec:        JSONCodec(),
+		transport:    MemoryTransport(),
 	}
 }
 
 type Network struct {
-	channels     map[string]chan<- []byte
+	mutex        sync.Mutex
+	nodes        map[string]*Node    // {id: node} local nodes that are not closed
+	members      map[string]struct{} // {id: null} added with AddNode or AddRemoteNode, the first members
+	learners     map[string]struct{} // {id: null} added with AddLearner or AddRemoteLearner
+	witnesses    map[string]struct{} // {id: null} set with SetWitness
+	weights      map[string]int      // {id: weight} for nodes whose vote does not count as 1
+	phase1Quorum int                 // Zero means more than half of the total weight
+	phase2Quorum int
 	stdoutLogger *log.Logger
 	stderrLogger *log.Logger
+	multiPaxos   bool
+	fastPaxos    bool
+	leaseReads   bool
+	syncInterval time.Duration // Zero means no anti-entropy
+	resendAfter  time.Duration // Zero means requests are never sent again
+	codec        Codec
+	transport    Transport
 }
 
-func (network *Network) AddRemoteNode(id string, channel chan<- []byte) {
-	network.channels[id] = channel
+// Tell the local nodes about a member somewhere else, which they reach through the transport
+func (network *Network) AddRemoteNode(id string) {
+	network.addMember(id)
 }
 
 func (network *Network) SetLoggers(stdout, stderr *log.Logger) {
 	network.stdoutLogger = stdout
 	network.stderrLogger = stderr
 }
+
+// Multi-Paxos mode elects a stable leader that runs phase 1 once for every key, after which each
+// write only needs phase 2. Other nodes forward their writes to the leader. It must be set the same
+// way on every node before any nodes are added.
+func (network *Network) SetMultiPaxos(enabled bool) {
+	network.multiPaxos = enabled
+}
+
+// The members before any membership change was decided
+func (network *Network) firstMembers() []string {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.firstMembersLocked()
+}
+
+func (network *Network) firstMembersLocked() []string {
+	ids := []string{}
+	for id := range network.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 )
 
 // A node does read and write operations on the entire network
@@ -12,461 +14,1053 @@ import (
 //     node.Read(ctx, key)
 //     node.Write(ctx, key, value)
 type Node struct {
+	id        string
+	network   *Network
+	life      *lifecycle
+	storage   Storage // Only to close, since the node loop owns it
 	readChan  chan<- *message
 	writeChan chan<- *message
+	batchChan chan<- []*message // Writes that start together
+	readsChan chan<- []*message // Reads that start together
+	watchChan chan<- *watchStruct
+	opChan    chan<- *message
 	cleanChan chan<- string
+
+	mutex       sync.Mutex
+	retryPolicy RetryPolicy
+}
+
+// Everything a node knows, only ever touched by the node's own goroutine
+type nodeLoop struct {
+	id        string
+	network   *Network
+	life      *lifecycle
+	storage   Storage
+	writeChan chan<- *message
+	receive   func(ctx context.Context, msg []byte) error // Hands the node a message it sent itself
+	meta      *metaStruct
+	config    *configStruct
+	leader    *leaderState // Only set in Multi-Paxos mode
+	learner   bool         // Never votes
+	witness   bool         // Keeps hashes of values rather than values
+
+	grantN     ballot    // Leader this node last granted a lease to
+	grantUntil time.Time // When that lease runs out
+
+	repliedAt map[string]time.Time // {id: when} the node last replied to a request
+	repliedTo map[string]time.Time // {id: sent} the latest request the node replied to
+
+	outbox    map[string][][]byte // {id: [message]} sent once the current event is handled
+	staged    map[string][]byte   // {key: state} written in one batch once the current event is handled
+
+	finals  map[string]struct{} // {key: null} final keys for anti-entropy, nil until loaded
+	digests [][sha512.Size]byte // XOR of the final keys and hashes in each bucket
+
+	msgMap                 map[string]*message                        // {opId: messageWithChannel}
+	othersAcceptedNMap     map[string]ballot                          // {opId: n}
+	othersAcceptedValueMap map[string][]byte                          // {opId: value}
+	othersAcceptedHashMap  map[string]string                          // {opId: hash}
+	proposedValueMap       map[string][]byte                          // {opId: value}
+	write1WaitingMap       map[string]map[ballot]map[string]struct{}  // {opId: {n: {sender: null}}}
+	write2WaitingMap       map[string]map[ballot]map[string]struct{}  // {opId: {n: {sender: null}}}
+	readWaitingMap         map[string]map[string]struct{}             // {opId: {sender: null}}
+	readSendersMap         map[string]map[readKey]map[string]struct{} // {opId: {{n, hash}: {sender: null}}}
+	readValueMap           map[string]map[readKey][]byte              // {opId: {{n, hash}: value}}
+	keysWaitingMap         map[string]map[string]struct{}             // {opId: {sender: null}}
+	keysRespondedMap       map[string]map[string]struct{}             // {opId: {sender: null}}
+	keysMap                map[string]map[string]struct{}             // {opId: {key: null}}
+	keysUntilMap           map[string]string                          // {opId: key} past which a member hit the limit
+	installWaitingMap      map[string]map[string]struct{}             // {opId: {sender: null}}
+	fastWaitingMap         map[string]map[string]struct{}             // {opId: {sender: null}}
+	fastVotesMap           map[string]map[string]struct{}             // {opId: {sender: null}}
+	fastAcceptedMap        map[string]map[string]map[string]struct{}  // {opId: {hash: {sender: null}}}
+	fastValueMap           map[string]map[string][]byte               // {opId: {hash: value}}
+	fetchMap               map[string]*fetchStruct                    // {opId: fetch}
+	watchMap               map[string]*watchStruct                    // {opId: watch}
+	pendingMap             map[string]*pendingStruct                  // {opId: pending}
 }
 
 // Creates a local node on the network with storage
-func (network *Network) AddNode(id string, channel <-chan []byte, storage *Storage) *Node {
-	// Everything from channel goes into msgChan
+func (network *Network) AddNode(id string, storage Storage) *Node {
+	node := network.AddNewNode(id, storage)
+	network.addMember(id)
+	return node
+}
+
+// Creates a local node that is not a member yet, so its vote does not count until AddMember
+func (network *Network) AddNewNode(id string, storage Storage) *Node {
+	return network.addNode(id, storage, false)
+}
+
+func (network *Network) addNode(id string, storage Storage, learner bool) *Node {
+	life := newLifecycle()
 	msgChan := make(chan []byte)
-	go func() {
-		for msgBytes := range channel {
-			msgChan <- msgBytes
+	receive := func(ctx context.Context, msgBytes []byte) error {
+		select {
+		case msgChan <- msgBytes:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-life.done:
+			return &ErrClosed{}
 		}
-		close(msgChan)
-	}()
+	}
 	readChan := make(chan *message)
 	writeChan := make(chan *message)
+	batchChan := make(chan []*message)
+	readsChan := make(chan []*message)
+	watchChan := make(chan *watchStruct)
+	opChan := make(chan *message)
 	cleanChan := make(chan string)
-	network.channels[id] = msgChan
+	node := &Node{
+		id:          id,
+		network:     network,
+		life:        life,
+		storage:     storage,
+		readChan:    readChan,
+		writeChan:   writeChan,
+		batchChan:   batchChan,
+		readsChan:   readsChan,
+		watchChan:   watchChan,
+		opChan:      opChan,
+		cleanChan:   cleanChan,
+		retryPolicy: DefaultRetryPolicy,
+	}
+	network.mutex.Lock()
+	network.nodes[id] = node
+	network.mutex.Unlock()
+	network.transport.Listen(id, receive)
+
+	loop := &nodeLoop{
+		id:                     id,
+		network:                network,
+		life:                   life,
+		learner:                learner,
+		witness:                network.isWitness(id),
+		storage:                storage,
+		writeChan:              writeChan,
+		receive:                receive,
+		repliedAt:              map[string]time.Time{},
+		repliedTo:              map[string]time.Time{},
+		outbox:                 map[string][][]byte{},
+		staged:                 map[string][]byte{},
+		msgMap:                 map[string]*message{},
+		othersAcceptedNMap:     map[string]ballot{},
+		othersAcceptedValueMap: map[string][]byte{},
+		othersAcceptedHashMap:  map[string]string{},
+		proposedValueMap:       map[string][]byte{},
+		write1WaitingMap:       map[string]map[ballot]map[string]struct{}{},
+		write2WaitingMap:       map[string]map[ballot]map[string]struct{}{},
+		readWaitingMap:         map[string]map[string]struct{}{},
+		readSendersMap:         map[string]map[readKey]map[string]struct{}{},
+		readValueMap:           map[string]map[readKey][]byte{},
+		keysWaitingMap:         map[string]map[string]struct{}{},
+		keysRespondedMap:       map[string]map[string]struct{}{},
+		keysMap:                map[string]map[string]struct{}{},
+		keysUntilMap:           map[string]string{},
+		installWaitingMap:      map[string]map[string]struct{}{},
+		fastWaitingMap:         map[string]map[string]struct{}{},
+		fastVotesMap:           map[string]map[string]struct{}{},
+		fastAcceptedMap:        map[string]map[string]map[string]struct{}{},
+		fastValueMap:           map[string]map[string][]byte{},
+		fetchMap:               map[string]*fetchStruct{},
+		watchMap:               map[string]*watchStruct{},
+		pendingMap:             map[string]*pendingStruct{},
+	}
+	if network.multiPaxos {
+		loop.leader = newLeaderState()
+	}
 
 	// Start a single goroutine for this node and communicate with it via channels to make it
 	// all thread safe
-	go func() {
-		msgMap := map[string]*message{}                                 // {opId: messageWithChannel}
-		othersAcceptedNMap := map[string]uint64{}                       // {opId: n}
-		othersAcceptedValueMap := map[string][]byte{}                   // {opId: value}
-		proposedValueMap := map[string][]byte{}                         // {opId: value}
-		write1WaitingMap := map[string]map[uint64]map[string]struct{}{} // {opId: {n: {sender: null}}}
-		write2WaitingMap := map[string]map[uint64]map[string]struct{}{} // {opId: {n: {sender: null}}}
-		readWaitingMap := map[string]map[string]struct{}{}              // {opId: {sender: null}}
-		readCountMap := map[string]map[string]int{}                     // {opId: {hash: count}}
-		readValueMap := map[string][]byte{}                             // {opId: value}
-		getState := func(key uint64) (*stateStruct, error) {
-			stateBytes, err := storage.Get(key)
-			if err != nil {
-				return nil, err
+	life.goroutine(func() {
+		loop.run(msgChan, readChan, writeChan, batchChan, readsChan, watchChan, opChan, cleanChan)
+	})
+
+	return node
+}
+
+func (loop *nodeLoop) run(msgChan <-chan []byte, readChan, writeChan <-chan *message, batchChan, readsChan <-chan []*message, watchChan <-chan *watchStruct, opChan <-chan *message, cleanChan <-chan string) {
+	meta, err := loop.getMeta()
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		meta = &metaStruct{}
+	}
+	loop.meta = meta
+	loop.loadConfig()
+	if loop.network.leasesOn() {
+		// This node may have granted a lease before it restarted
+		loop.grantN = meta.PromisedN
+		loop.grantUntil = time.Now().Add(leaseDuration)
+	}
+
+	tickChan := (<-chan time.Time)(nil)
+	if loop.leader != nil {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		tickChan = ticker.C
+	}
+	resendChan := (<-chan time.Time)(nil)
+	if 0 < loop.network.resendAfter {
+		ticker := time.NewTicker(loop.network.resendAfter / 2)
+		defer ticker.Stop()
+		resendChan = ticker.C
+	}
+	syncChan := (<-chan time.Time)(nil)
+	if 0 < loop.network.syncInterval && loop.canListKeys() {
+		ticker := time.NewTicker(loop.network.syncInterval)
+		defer ticker.Stop()
+		syncChan = ticker.C
+	}
+
+	for {
+		select {
+		case <-loop.life.done:
+			return
+		case msgBytes := <-msgChan:
+			loop.network.stdoutLogger.Printf("%s: %s", loop.id, msgBytes)
+
+			if msg, err := loop.network.decodeMessage(msgBytes); err != nil {
+				loop.network.stderrLogger.Print(err)
+			} else {
+				loop.handleMessage(msg)
 			}
-			state, err := &stateStruct{}, error(nil)
-			if 0 < len(stateBytes) {
-				err = json.Unmarshal(stateBytes, state)
+		case msg := <-readChan:
+			loop.startRead(msg)
+		case msg := <-writeChan:
+			loop.handleWrite(msg)
+		case msgs := <-batchChan:
+			for _, msg := range msgs {
+				loop.handleWrite(msg)
 			}
-			return state, err
+		case msgs := <-readsChan:
+			for _, msg := range msgs {
+				loop.startRead(msg)
+			}
+		case watch := <-watchChan:
+			loop.startWatch(watch)
+		case msg := <-opChan:
+			loop.handleOp(msg)
+		case <-tickChan:
+			loop.tick()
+		case <-resendChan:
+			loop.resend()
+		case <-syncChan:
+			loop.startSync()
+		case opID := <-cleanChan:
+			// Cleanup after timeouts
+			loop.clean(opID)
 		}
-		putState := func(key uint64, state *stateStruct) error {
-			stateBytes, err := json.Marshal(state)
-			if err != nil {
-				return err
+		loop.commit()
+		loop.flush()
+	}
+}
+
+func (loop *nodeLoop) handleWrite(msg *message) {
+	if loop.leader != nil && !msg.Repair {
+		loop.msgMap[msg.OpID] = msg
+		loop.leadWrite(msg)
+		return
+	}
+	if loop.network.fastPaxos && !msg.Repair && msg.Attempts == 0 {
+		loop.startFast(msg)
+		return
+	}
+	loop.startWrite(msg)
+}
+
+func (loop *nodeLoop) handleMessage(msg *message) {
+	if msg.Type == batchType {
+		loop.handleBatch(msg)
+		return
+	}
+	if !loop.checkEpoch(msg) || loop.learnerIgnores(msg) {
+		return
+	}
+	loop.heardReply(msg)
+
+	// Messages about the node as a whole rather than a single key
+	switch msg.Type {
+	case leaderPrepareType:
+		loop.handleLeaderPrepare(msg)
+		return
+	case leaderPromiseType:
+		loop.handleLeaderPromise(msg)
+		return
+	case leaderNackType:
+		loop.handleLeaderNack(msg)
+		return
+	case heartbeatType:
+		loop.handleHeartbeat(msg)
+		return
+	case forwardType:
+		loop.handleForward(msg)
+		return
+	case keysRequestType:
+		loop.handleKeysRequest(msg)
+		return
+	case keysResponseType:
+		loop.handleKeysResponse(msg)
+		return
+	case installResponseType:
+		loop.handleInstallResponse(msg)
+		return
+	case leaseGrantType:
+		loop.handleLeaseGrant(msg)
+		return
+	case valueResponseType:
+		loop.handleValueResponse(msg)
+		return
+	case syncRequestType:
+		loop.handleSyncRequest(msg)
+		return
+	case syncResponseType:
+		loop.handleSyncResponse(msg)
+		return
+	case finalsRequestType:
+		loop.handleFinalsRequest(msg)
+		return
+	}
+
+	// Get the state
+	state, err := loop.getState(msg.Key)
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	switch msg.Type {
+	case installType:
+		loop.handleInstall(msg, state)
+		return
+	case valueRequestType:
+		loop.handleValueRequest(msg, state)
+		return
+	}
+	if state.Final {
+		switch msg.Type {
+		case readRequestType, write1RequestType, write2RequestType, fastRequestType:
+			// Inform the sender
+			loop.send(msg.Sender, &message{
+				Type:  finalType,
+				OpID:  msg.OpID,
+				Key:   msg.Key,
+				Value: state.Value,
+				Hash:  state.Hash,
+			})
+			return
+		case finalType:
+		default:
+			// Decided while this node was still waiting on responses
+			if state.Hash != "" {
+				loop.fetchFinal(&message{Sender: loop.id, OpID: msg.OpID, Key: msg.Key, Hash: state.Hash})
+				return
 			}
-			return storage.Put(key, stateBytes)
+			loop.decided(msg.OpID, msg.Key, state.Value)
+			return
+		}
+	}
+
+	switch msg.Type {
+	case readRequestType:
+		loop.send(msg.Sender, &message{
+			OpID:      msg.OpID,
+			Type:      readResponseType,
+			AcceptedN: state.AcceptedN,
+			Key:       msg.Key,
+			Value:     state.Value,
+			Hash:      state.Hash,
+		})
+	case readResponseType:
+		loop.handleReadResponse(msg)
+	case write1RequestType:
+		loop.handleWrite1Request(msg, state)
+	case write1ResponseType:
+		loop.handleWrite1Response(msg)
+	case write1NackType:
+		loop.handleNack(msg, state, loop.write1WaitingMap)
+	case write2RequestType:
+		loop.handleWrite2Request(msg, state)
+	case write2ResponseType:
+		loop.handleWrite2Response(msg)
+	case fastRequestType:
+		loop.handleFastRequest(msg, state)
+	case fastResponseType:
+		loop.handleFastResponse(msg)
+	case write2NackType:
+		if loop.leader != nil {
+			loop.handleLeadWriteNack(msg)
+			return
 		}
+		loop.handleNack(msg, state, loop.write2WaitingMap)
+	case finalType:
+		// loop.network.stdoutLogger.Printf("Final Key=%q Value=%s", msg.Key, msg.Value)
 
-		for {
-			select {
-			case msgBytes, ok := <-msgChan:
-				if !ok {
-					return // Channel is closed
-				}
-				network.stdoutLogger.Printf("%s: %s", id, msgBytes)
-
-				msg := &message{}
-				if err := json.Unmarshal(msgBytes, msg); err != nil {
-					network.stderrLogger.Print(err)
-					continue
-				}
-
-				// Get the state
-				state, err := getState(msg.Key)
-				if err != nil {
-					network.stderrLogger.Print(err)
-					continue
-				}
-				// If state is final, inform the sender
-				if state.Final && msg.Type != finalType {
-					go func() {
-						network.channels[msg.Sender] <- encodeMessage(&message{
-							Type:   finalType,
-							Sender: id,
-							OpID:   msg.OpID,
-							Key:    msg.Key,
-							Value:  state.Value,
-						})
-					}()
-					continue
-				}
-
-				switch msg.Type {
-				case readRequestType:
-					go func() {
-						network.channels[msg.Sender] <- encodeMessage(&message{
-							OpID:   msg.OpID,
-							Sender: id,
-							Type:   readResponseType,
-							Key:    msg.Key,
-							Value:  state.Value,
-						})
-					}()
-				case readResponseType:
-					if waitingMap, ok := readWaitingMap[msg.OpID]; ok {
-						if _, ok := waitingMap[msg.Sender]; ok {
-							delete(waitingMap, msg.Sender)
-
-							hash := getHash(msg.Value)
-							countMap := readCountMap[msg.OpID]
-							countMap[hash]++
-							if countMap[getHash(readValueMap[msg.OpID])] < countMap[hash] {
-								readValueMap[msg.OpID] = msg.Value
-
-								// If a majority is not possible, finish
-								others := 0
-								for hash2, count := range countMap {
-									if hash2 != hash {
-										others += count
-									}
-								}
-								if l := len(network.channels); l-others <= others {
-									// Majority not possible
-									if msg2, ok := msgMap[msg.OpID]; ok {
-										delete(msgMap, msg.OpID)
-										go func() {
-											msg2.ResponseChan <- nil
-											msg2.ErrChan <- nil
-										}()
-										go func() {
-											cleanChan <- msg.OpID
-										}()
-									}
-									continue
-								}
-							}
-							if l, c := len(network.channels), countMap[hash]; l-c < c {
-								// Majority are nil
-								if msg.Value == nil {
-									if msg2, ok := msgMap[msg.OpID]; ok {
-										delete(msgMap, msg.OpID)
-										go func() {
-											msg2.ResponseChan <- nil
-											msg2.ErrChan <- nil
-										}()
-										go func() {
-											cleanChan <- msg.OpID
-										}()
-									}
-									continue
-								}
-								// Majority have same value
-								for _, channel2 := range network.channels {
-									go func(channel2 chan<- []byte) {
-										channel2 <- encodeMessage(&message{
-											Type:   finalType,
-											Sender: id,
-											OpID:   msg.OpID,
-											Key:    msg.Key,
-											Value:  msg.Value,
-										})
-									}(channel2)
-								}
-							}
-						}
-					}
-				case write1RequestType:
-					if state.PromisedN < msg.N {
-						// Promise
-						state.PromisedN = msg.N
-						if err := putState(msg.Key, state); err != nil {
-							network.stderrLogger.Print(err)
-							continue
-						}
-						// network.stdoutLogger.Printf("Promised N=%d to %s", msg.N, msg.Sender)
-						go func() {
-							network.channels[msg.Sender] <- encodeMessage(&message{
-								Type:      write1ResponseType,
-								OpID:      msg.OpID,
-								Sender:    id,
-								N:         msg.N,
-								AcceptedN: state.AcceptedN,
-								Key:       msg.Key,
-								Value:     state.Value,
-							})
-						}()
-					} else {
-						go func() {
-							network.channels[msg.Sender] <- encodeMessage(&message{
-								Type:   write1NackType,
-								OpID:   msg.OpID,
-								Sender: id,
-								N:      msg.N,
-								Key:    msg.Key,
-							})
-						}()
-					}
-				case write1ResponseType:
-					if waitingMap1, ok := write1WaitingMap[msg.OpID]; ok {
-						if waitingMap2, ok := waitingMap1[msg.N]; ok {
-							if othersAcceptedNMap[msg.OpID] < msg.AcceptedN {
-								othersAcceptedNMap[msg.OpID] = msg.AcceptedN
-								othersAcceptedValueMap[msg.OpID] = msg.Value
-							}
-							delete(waitingMap2, msg.Sender)
-							if n, w := len(network.channels), len(waitingMap2); w < n-w {
-								// Majority have responded
-								delete(waitingMap1, msg.N) // No longer waiting on phase1
-
-								value := proposedValueMap[msg.OpID]
-								if 0 < othersAcceptedNMap[msg.OpID] {
-									value = othersAcceptedValueMap[msg.OpID]
-								}
-
-								waitingMap3, ok := write2WaitingMap[msg.OpID]
-								if !ok {
-									waitingMap3 = map[uint64]map[string]struct{}{}
-									write2WaitingMap[msg.OpID] = waitingMap3
-								}
-								waitingMap4 := map[string]struct{}{}
-								waitingMap3[msg.N] = waitingMap4
-								for id2, channel2 := range network.channels {
-									waitingMap4[id2] = struct{}{}
-									go func(channel2 chan<- []byte) {
-										channel2 <- encodeMessage(&message{
-											Type:   write2RequestType,
-											OpID:   msg.OpID,
-											Sender: id,
-											N:      msg.N,
-											Key:    msg.Key,
-											Value:  value,
-										})
-									}(channel2)
-								}
-							}
-						}
-					}
-				case write1NackType:
-					if waitingMap, ok := write1WaitingMap[msg.OpID]; ok {
-						if _, ok := waitingMap[msg.N]; ok {
-							delete(waitingMap, msg.N)
-							msg2 := msgMap[msg.OpID]
-							// Retry write
-							go func() {
-								writeChan <- msg2
-							}()
-						}
-					}
-				case write2RequestType:
-					if state.PromisedN <= msg.N {
-						state.AcceptedN = msg.N
-						state.Value = msg.Value
-						if err := putState(msg.Key, state); err != nil {
-							network.stderrLogger.Print(err)
-							continue
-						}
-						// network.stdoutLogger.Printf("Accepted Key=%d Value=%s Sender=%s N=%d", msg.Key, msg.Value, msg.Sender, msg.N)
-						go func() {
-							network.channels[msg.Sender] <- encodeMessage(&message{
-								Type:   write2ResponseType,
-								Sender: id,
-								OpID:   msg.OpID,
-								N:      msg.N,
-								Key:    msg.Key,
-								Value:  msg.Value,
-							})
-						}()
-					} else {
-						go func() {
-							network.channels[msg.Sender] <- encodeMessage(&message{
-								Type:   write2NackType,
-								OpID:   msg.OpID,
-								Sender: id,
-								N:      msg.N,
-								Key:    msg.Key,
-							})
-						}()
-					}
-				case write2ResponseType:
-					if waitingMap1, ok := write2WaitingMap[msg.OpID]; ok {
-						if waitingMap2, ok := waitingMap1[msg.N]; ok {
-							delete(waitingMap2, msg.Sender)
-							if n, w := len(network.channels), len(waitingMap2); w < n-w {
-								// Majority have responded
-								delete(waitingMap1, msg.N) // No longer waiting on phase2
-
-								for _, channel2 := range network.channels {
-									go func(channel2 chan<- []byte) {
-										channel2 <- encodeMessage(&message{
-											Type:   finalType,
-											Sender: id,
-											OpID:   msg.OpID,
-											Key:    msg.Key,
-											Value:  msg.Value,
-										})
-									}(channel2)
-								}
-							}
-						}
-					}
-				case write2NackType:
-					if waitingMap, ok := write2WaitingMap[msg.OpID]; ok {
-						if _, ok := waitingMap[msg.N]; ok {
-							delete(waitingMap, msg.N)
-							msg2 := msgMap[msg.OpID]
-							// Retry write
-							go func() {
-								writeChan <- msg2
-							}()
-						}
-					}
-				case finalType:
-					// network.stdoutLogger.Printf("Final Key=%d Value=%s", msg.Key, msg.Value)
-
-					if msg2, ok := msgMap[msg.OpID]; ok {
-						if !state.Final {
-							if err := putState(msg.Key, &stateStruct{
-								Value: msg.Value,
-								Final: true,
-							}); err != nil {
-								network.stderrLogger.Print(err)
-								continue
-							}
-						}
-
-						go func(msg2 *message) {
-							msg2.ResponseChan <- msg.Value
-							msg2.ErrChan <- nil
-						}(msg2)
-
-						go func() {
-							cleanChan <- msg.OpID
-						}()
-					}
-				default:
-					network.stderrLogger.Printf("Illegal message type: %d", msg.Type)
-				}
-			case msg := <-readChan:
-				msgMap[msg.OpID] = msg
-				waitingMap := map[string]struct{}{}
-				readWaitingMap[msg.OpID] = waitingMap
-				countMap := map[string]int{}
-				readCountMap[msg.OpID] = countMap
-				for id2, channel2 := range network.channels {
-					waitingMap[id2] = struct{}{}
-					go func(channel2 chan<- []byte) {
-						channel2 <- encodeMessage(&message{
-							OpID:   msg.OpID,
-							Sender: id,
-							Type:   readRequestType,
-							Key:    msg.Key,
-						})
-					}(channel2)
-				}
-			case msg := <-writeChan:
-				// Start a round of Paxos for the given key
-				state, err := getState(msg.Key)
-				if err != nil {
-					msg.ResponseChan <- nil
-					msg.ErrChan <- err
-					continue
-				}
-				state.N++
-				if err := putState(msg.Key, state); err != nil {
-					msg.ResponseChan <- nil
-					msg.ErrChan <- err
-					continue
-				}
-
-				proposedValueMap[msg.OpID] = msg.Value
-				msgMap[msg.OpID] = msg
-				waitingMap1, ok := write1WaitingMap[msg.OpID]
-				if !ok {
-					waitingMap1 = map[uint64]map[string]struct{}{}
-					write1WaitingMap[msg.OpID] = waitingMap1
-				}
-				waitingMap2 := map[string]struct{}{}
-				waitingMap1[state.N] = waitingMap2
-				for id2, channel2 := range network.channels {
-					waitingMap2[id2] = struct{}{}
-					go func(channel2 chan<- []byte) {
-						channel2 <- encodeMessage(&message{
-							Type:   write1RequestType,
-							Sender: id,
-							OpID:   msg.OpID,
-							N:      state.N,
-							Key:    msg.Key,
-						})
-					}(channel2)
-				}
-			case opID := <-cleanChan:
-				// Cleanup after timeouts
-				delete(msgMap, opID)
-				delete(othersAcceptedNMap, opID)
-				delete(othersAcceptedValueMap, opID)
-				delete(proposedValueMap, opID)
-				delete(write1WaitingMap, opID)
-				delete(write2WaitingMap, opID)
-				delete(readWaitingMap, opID)
-				delete(readCountMap, opID)
-				delete(readValueMap, opID)
+		if msg.Value == nil && msg.Hash != "" {
+			loop.fetchFinal(msg)
+			return
+		}
+		if !state.Final {
+			if err := loop.putState(msg.Key, &stateStruct{
+				Value: msg.Value,
+				Final: true,
+			}); err != nil {
+				loop.network.stderrLogger.Print(err)
+				return
+			}
+			if loop.leader != nil {
+				loop.forgetAccepted(msg.Key)
+			}
+			if isConfigKey(msg.Key) {
+				loop.adoptConfig(msg.Value)
 			}
+			loop.learned(msg.Key, msg.Value)
 		}
-	}()
+		loop.decided(msg.OpID, msg.Key, msg.Value)
+	default:
+		loop.network.stderrLogger.Printf("Illegal message type: %d", msg.Type)
+	}
+}
 
-	return &Node{
-		readChan:  readChan,
-		writeChan: writeChan,
-		cleanChan: cleanChan,
+func (loop *nodeLoop) handleReadResponse(msg *message) {
+	waitingMap, ok := loop.readWaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	if _, ok := waitingMap[msg.Sender]; !ok {
+		return
+	}
+	delete(waitingMap, msg.Sender)
+
+	key := newReadKey(msg)
+	sendersMap := loop.readSendersMap[msg.OpID]
+	if _, ok := sendersMap[key]; !ok {
+		sendersMap[key] = map[string]struct{}{}
+	}
+	sendersMap[key][msg.Sender] = struct{}{}
+	if msg.Value != nil {
+		loop.readValueMap[msg.OpID][key] = msg.Value // Witnesses only send the hash
+	}
+	switch {
+	case !loop.isQuorum(sendersMap[key], key.phase()):
+		if !loop.readPossible(msg.OpID) {
+			loop.recoverRead(msg.OpID)
+		}
+	case key.Hash == "":
+		// Nothing accepted by a phase 1 quorum, so no phase 2 quorum accepted anything
+		loop.finish(msg.OpID, nil, nil)
+	default:
+		// A phase 2 quorum accepted the same value in the same round, so it is chosen
+		loop.broadcastFinal(&message{
+			Type:  finalType,
+			OpID:  msg.OpID,
+			Key:   msg.Key,
+			Value: loop.readValueMap[msg.OpID][key],
+		})
 	}
 }
 
-// Read a key. Returns nil when the value does not exist. Use context if you want a timeout or
-// cancelation.
-func (node *Node) Read(ctx context.Context, key uint64) ([]byte, error) {
-	respChan, errChan := make(chan []byte, 1), make(chan error, 1)
-	opID := newOpID()
-	go func() {
-		node.readChan <- &message{
-			OpID:         opID,
-			Key:          key,
-			ResponseChan: respChan,
-			ErrChan:      errChan,
+// The responses don't show whether anything was chosen, which happens when a write is in progress
+// or its proposer went away. Run a round that proposes whatever might have been chosen, so the read
+// finds out for sure without making up a value.
+func (loop *nodeLoop) recoverRead(opID string) {
+	msg, ok := loop.msgMap[opID]
+	if !ok {
+		return
+	}
+	delete(loop.readWaitingMap, opID)
+	delete(loop.readSendersMap, opID)
+	delete(loop.readValueMap, opID)
+	if loop.leader != nil {
+		// The leader finishes its own writes, and a round from here would only get in its way
+		loop.finish(opID, nil, &ErrUndecided{Key: msg.Key})
+		return
+	}
+	msg.Repair = true
+	msg.ForRead = true
+	loop.startWrite(msg)
+}
+
+// Answer reads of a key that was just decided, since their responses may never settle on it
+func (loop *nodeLoop) finishReads(key string, value []byte) {
+	for opID := range loop.readWaitingMap {
+		if msg, ok := loop.msgMap[opID]; ok && msg.Key == key {
+			loop.finish(opID, value, nil)
+		}
+	}
+}
+
+// Whether the nodes still being waited on could give a read a quorum for any value
+func (loop *nodeLoop) readPossible(opID string) bool {
+	waitingMap := loop.readWaitingMap[opID]
+	if loop.isQuorum(waitingMap, phase2) {
+		return true // For a value nobody has reported yet
+	}
+	for key, senders := range loop.readSendersMap[opID] {
+		ids := map[string]struct{}{}
+		for id := range senders {
+			ids[id] = struct{}{}
+		}
+		for id := range waitingMap {
+			ids[id] = struct{}{}
+		}
+		if loop.isQuorum(ids, key.phase()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (loop *nodeLoop) handleWrite1Request(msg *message, state *stateStruct) {
+	if promisedN := loop.promisedN(state); !msg.N.less(promisedN) && !loop.leaseRefuses(msg.N) {
+		// Promise, or promise again when the request was sent again
+		state.PromisedN = msg.N
+		if err := loop.putState(msg.Key, state); err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+		// loop.network.stdoutLogger.Printf("Promised N=%v to %s", msg.N, msg.Sender)
+		loop.send(msg.Sender, &message{
+			Type:      write1ResponseType,
+			OpID:      msg.OpID,
+			N:         msg.N,
+			AcceptedN: state.AcceptedN,
+			Key:       msg.Key,
+			Value:     state.Value,
+			Hash:      state.Hash,
+		})
+	} else {
+		loop.send(msg.Sender, &message{
+			Type:      write1NackType,
+			OpID:      msg.OpID,
+			N:         msg.N,
+			PromisedN: promisedN,
+			Key:       msg.Key,
+		})
+	}
+}
+
+func (loop *nodeLoop) handleWrite1Response(msg *message) {
+	waitingMap1, ok := loop.write1WaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	waitingMap2, ok := waitingMap1[msg.N]
+	if !ok {
+		return
+	}
+	if acceptedN := loop.othersAcceptedNMap[msg.OpID]; acceptedN.less(msg.AcceptedN) {
+		loop.othersAcceptedNMap[msg.OpID] = msg.AcceptedN
+		loop.othersAcceptedValueMap[msg.OpID] = msg.Value
+		loop.othersAcceptedHashMap[msg.OpID] = valueHash(msg)
+	} else if acceptedN == msg.AcceptedN && msg.Value != nil {
+		// A ballot has one value, which a witness only sent the hash of
+		loop.othersAcceptedValueMap[msg.OpID] = msg.Value
+	}
+	loop.recordFastAccepted(msg)
+	delete(waitingMap2, msg.Sender)
+	if loop.quorumResponded(waitingMap2, phase1) {
+		delete(waitingMap1, msg.N) // No longer waiting on phase1
+
+		hash, acceptedValue := "", []byte(nil)
+		switch acceptedN := loop.othersAcceptedNMap[msg.OpID]; {
+		case acceptedN == fastBallot:
+			// Acceptors can disagree in the fast round, so only keep a value that might be chosen
+			hash = loop.fastHash(msg.OpID, waitingMap2)
+			acceptedValue = loop.fastValueMap[msg.OpID][hash]
+		case !acceptedN.isZero():
+			hash, acceptedValue = loop.othersAcceptedHashMap[msg.OpID], loop.othersAcceptedValueMap[msg.OpID]
+		}
+		if hash != "" && acceptedValue == nil {
+			// Only witnesses reported it. If no other member has it either, it was never chosen.
+			opID, key, n := msg.OpID, msg.Key, msg.N
+			loop.fetch(opID, key, hash, func(value []byte) {
+				loop.propose(opID, key, n, value)
+			})
+			return
+		}
+		loop.propose(msg.OpID, msg.Key, msg.N, acceptedValue)
+	}
+}
+
+// Start phase 2 with the value phase 1 found, or this node's own value when nothing was chosen
+func (loop *nodeLoop) propose(opID string, key string, n ballot, acceptedValue []byte) {
+	value := loop.proposedValueMap[opID]
+	if acceptedValue != nil {
+		value = acceptedValue
+	} else if msg, ok := loop.msgMap[opID]; ok && msg.Repair {
+		// Nothing was chosen, so there is nothing to repair
+		loop.finish(opID, nil, nil)
+		return
+	}
+	loop.startPhase2(opID, key, n, value)
+}
+
+func (loop *nodeLoop) handleNack(msg *message, state *stateStruct, waitingMap1 map[string]map[ballot]map[string]struct{}) {
+	waitingMap, ok := waitingMap1[msg.OpID]
+	if !ok {
+		return
+	}
+	if _, ok := waitingMap[msg.N]; !ok {
+		return
+	}
+	delete(waitingMap, msg.N)
+	// Skip past the ballot that beat us so the retry can win
+	if state.N < msg.PromisedN.Round {
+		state.N = msg.PromisedN.Round
+		if err := loop.putState(msg.Key, state); err != nil {
+			loop.network.stderrLogger.Print(err)
+		}
+	}
+	loop.retry(msg.OpID)
+}
+
+func (loop *nodeLoop) handleWrite2Request(msg *message, state *stateStruct) {
+	if promisedN := loop.promisedN(state); !msg.N.less(promisedN) && !loop.leaseRefuses(msg.N) {
+		if loop.leader != nil {
+			if err := loop.rememberAccepted(msg.Key); err != nil {
+				loop.network.stderrLogger.Print(err)
+				return
+			}
+		}
+		state.PromisedN = msg.N
+		state.AcceptedN = msg.N
+		state.Value = msg.Value
+		if err := loop.putState(msg.Key, state); err != nil {
+			loop.network.stderrLogger.Print(err)
+			return
+		}
+		// loop.network.stdoutLogger.Printf("Accepted Key=%q Value=%s Sender=%s N=%v", msg.Key, msg.Value, msg.Sender, msg.N)
+		loop.send(msg.Sender, &message{
+			Type:  write2ResponseType,
+			OpID:  msg.OpID,
+			N:     msg.N,
+			Key:   msg.Key,
+			Value: msg.Value,
+		})
+	} else {
+		loop.send(msg.Sender, &message{
+			Type:      write2NackType,
+			OpID:      msg.OpID,
+			N:         msg.N,
+			PromisedN: promisedN,
+			Key:       msg.Key,
+		})
+	}
+}
+
+func (loop *nodeLoop) handleWrite2Response(msg *message) {
+	waitingMap1, ok := loop.write2WaitingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	waitingMap2, ok := waitingMap1[msg.N]
+	if !ok {
+		return
+	}
+	delete(waitingMap2, msg.Sender)
+	if loop.quorumResponded(waitingMap2, phase2) {
+		delete(waitingMap1, msg.N) // No longer waiting on phase2
+
+		loop.broadcastFinal(&message{
+			Type:  finalType,
+			OpID:  msg.OpID,
+			Key:   msg.Key,
+			Value: msg.Value,
+		})
+		if msg2, ok := loop.msgMap[msg.OpID]; ok && msg2.Repair {
+			// The current members accepted it, which is all a repair needs
+			loop.finish(msg.OpID, msg.Value, nil)
 		}
-	}()
+	}
+}
+
+// Ask every node for its value of a key
+func (loop *nodeLoop) startRead(msg *message) {
+	loop.msgMap[msg.OpID] = msg
+	if value, ok := loop.readLocal(msg.Key); ok {
+		loop.finish(msg.OpID, value, nil)
+		return
+	}
+	request := &message{
+		OpID: msg.OpID,
+		Type: readRequestType,
+		Key:  msg.Key,
+	}
+	loop.readWaitingMap[msg.OpID] = loop.broadcast(request)
+	loop.expect(request)
+	loop.readSendersMap[msg.OpID] = map[readKey]map[string]struct{}{}
+	loop.readValueMap[msg.OpID] = map[readKey][]byte{}
+}
+
+// Start a round of Paxos for the given key
+func (loop *nodeLoop) startWrite(msg *message) {
+	state, err := loop.getState(msg.Key)
+	if err != nil {
+		respond(msg, nil, err)
+		return
+	}
+	// Pick a round higher than anything this node has seen for the key, and tag it with this
+	// node's ID so that no other node can propose with the same ballot
+	for _, n := range []ballot{state.PromisedN, state.AcceptedN, loop.meta.PromisedN} {
+		if state.N < n.Round {
+			state.N = n.Round
+		}
+	}
+	state.N++
+	n := ballot{Round: state.N, NodeID: loop.id}
+	if err := loop.putState(msg.Key, state); err != nil {
+		respond(msg, nil, err)
+		return
+	}
+
+	loop.proposedValueMap[msg.OpID] = msg.Value
+	loop.msgMap[msg.OpID] = msg
+	waitingMap1, ok := loop.write1WaitingMap[msg.OpID]
+	if !ok {
+		waitingMap1 = map[ballot]map[string]struct{}{}
+		loop.write1WaitingMap[msg.OpID] = waitingMap1
+	}
+	request := &message{
+		Type: write1RequestType,
+		OpID: msg.OpID,
+		N:    n,
+		Key:  msg.Key,
+	}
+	waitingMap1[n] = loop.broadcast(request)
+	loop.expect(request)
+}
+
+// Ask every node to accept a value (phase 2)
+func (loop *nodeLoop) startPhase2(opID string, key string, n ballot, value []byte) {
+	waitingMap1, ok := loop.write2WaitingMap[opID]
+	if !ok {
+		waitingMap1 = map[ballot]map[string]struct{}{}
+		loop.write2WaitingMap[opID] = waitingMap1
+	}
+	request := &message{
+		Type:  write2RequestType,
+		OpID:  opID,
+		N:     n,
+		Key:   key,
+		Value: value,
+	}
+	waitingMap1[n] = loop.broadcast(request)
+	loop.expect(request)
+}
+
+// Put a write back through writeChan after backing off, if its caller is still waiting
+func (loop *nodeLoop) retry(opID string) {
+	msg, ok := loop.msgMap[opID]
+	if !ok {
+		return
+	}
+	if msg.ForRead {
+		// Another proposer is still at it, and only it knows what it wants
+		loop.finish(opID, nil, &ErrUndecided{Key: msg.Key})
+		return
+	}
+	policy := msg.RetryPolicy
+	if policy == nil {
+		policy = &DefaultRetryPolicy
+	}
+	msg.Attempts++
+	if 0 < policy.MaxAttempts && policy.MaxAttempts <= msg.Attempts {
+		loop.finish(opID, nil, &ErrMaxAttempts{Key: msg.Key, Attempts: msg.Attempts})
+		return
+	}
+	done := (<-chan struct{})(nil)
+	if msg.Ctx != nil {
+		done = msg.Ctx.Done()
+	}
+	wait := policy.backoff(msg.Attempts)
+	loop.life.goroutine(func() {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			loop.rewrite(msg)
+		case <-done:
+			// The caller gave up and cleans up after itself
+		case <-loop.life.done:
+		}
+	})
+}
+
+// Hand a write back to the node's goroutine to start over
+func (loop *nodeLoop) rewrite(msg *message) {
 	select {
-	case resp := <-respChan:
-		return resp, <-errChan
-	case <-ctx.Done():
-		go func() {
-			node.cleanChan <- opID
-		}()
-		return nil, ctx.Err()
+	case loop.writeChan <- msg:
+	case <-loop.life.done:
+	}
+}
+
+// A key has its final value, so every operation waiting on it is done
+func (loop *nodeLoop) decided(opID string, key string, value []byte) {
+	if msg, ok := loop.msgMap[opID]; ok && msg.Repair && !msg.ForRead {
+		loop.install(opID, key, value)
+		return
+	}
+	if loop.leader != nil {
+		loop.finishProposals(key, value)
+	}
+	loop.finish(opID, value, nil)
+}
+
+// Reply to the caller of an operation and forget about it
+func (loop *nodeLoop) finish(opID string, value []byte, err error) {
+	if msg, ok := loop.msgMap[opID]; ok {
+		respond(msg, value, err)
+	}
+	loop.clean(opID)
+}
+
+func (loop *nodeLoop) clean(opID string) {
+	delete(loop.msgMap, opID)
+	delete(loop.othersAcceptedNMap, opID)
+	delete(loop.othersAcceptedValueMap, opID)
+	delete(loop.othersAcceptedHashMap, opID)
+	delete(loop.proposedValueMap, opID)
+	delete(loop.write1WaitingMap, opID)
+	delete(loop.write2WaitingMap, opID)
+	delete(loop.readWaitingMap, opID)
+	delete(loop.readSendersMap, opID)
+	delete(loop.readValueMap, opID)
+	delete(loop.keysWaitingMap, opID)
+	delete(loop.keysRespondedMap, opID)
+	delete(loop.keysMap, opID)
+	delete(loop.keysUntilMap, opID)
+	delete(loop.installWaitingMap, opID)
+	delete(loop.fastWaitingMap, opID)
+	delete(loop.fastVotesMap, opID)
+	delete(loop.fastAcceptedMap, opID)
+	delete(loop.fastValueMap, opID)
+	delete(loop.fetchMap, opID)
+	delete(loop.watchMap, opID)
+	delete(loop.pendingMap, opID)
+	if loop.leader != nil {
+		delete(loop.leader.forwarded, opID)
+		delete(loop.leader.queued, opID)
 	}
 }
 
+// Send a message to a single node without blocking
+func (loop *nodeLoop) send(to string, msg *message) {
+	loop.multicast(map[string]struct{}{to: {}}, msg)
+}
+
+// Send a message to every member without blocking. Returns the nodes it was sent to.
+func (loop *nodeLoop) broadcast(msg *message) map[string]struct{} {
+	return loop.multicast(loop.members(), msg)
+}
+
+// Send a final value to every member and learner, and to this node so that it learns the value even
+// when it is not a member
+func (loop *nodeLoop) broadcastFinal(msg *message) {
+	ids := loop.withLearners(loop.members())
+	ids[loop.id] = struct{}{}
+	loop.multicast(ids, msg)
+}
+
+// Send a message to some nodes without blocking, once the current event is handled. Returns the
+// nodes it was sent to, including any that cannot be reached so that they are waited on like any
+// other.
+func (loop *nodeLoop) multicast(ids map[string]struct{}, msg *message) map[string]struct{} {
+	msg.Sender = loop.id
+	msg.Epoch = loop.config.Epoch
+	msgBytes := loop.network.encodeMessage(msg)
+	sent := map[string]struct{}{}
+	for id2 := range ids {
+		sent[id2] = struct{}{}
+		if msgBytes != nil {
+			loop.queue(id2, msgBytes)
+		}
+	}
+	return sent
+}
+
+// The highest ballot this node has promised for a key, including any promise to a leader
+func (loop *nodeLoop) promisedN(state *stateStruct) ballot {
+	if state.PromisedN.less(loop.meta.PromisedN) {
+		return loop.meta.PromisedN
+	}
+	return state.PromisedN
+}
+
+func (loop *nodeLoop) getState(key string) (*stateStruct, error) {
+	stateBytes, ok := loop.staged[key]
+	if !ok {
+		stateBytes2, err := loop.storage.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		stateBytes = stateBytes2
+	}
+	state, err := &stateStruct{}, error(nil)
+	if 0 < len(stateBytes) {
+		err = json.Unmarshal(stateBytes, state)
+	}
+	return state, err
+}
+
+func (loop *nodeLoop) putState(key string, state *stateStruct) error {
+	if loop.witness && !isReserved(key) && state.Value != nil {
+		// Keep configurations whole, since a witness needs them to know the members
+		state.Hash = getHash(state.Value)
+		state.Value = nil
+	}
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	loop.staged[key] = stateBytes
+	if loop.finals != nil && state.Final && !isReserved(key) {
+		loop.addFinal(key, state)
+	}
+	return nil
+}
+
+func (loop *nodeLoop) getMeta() (*metaStruct, error) {
+	metaBytes, err := loop.storage.Get(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := &metaStruct{}, error(nil)
+	if 0 < len(metaBytes) {
+		err = json.Unmarshal(metaBytes, meta)
+	}
+	return meta, err
+}
+
+func (loop *nodeLoop) putMeta() error {
+	metaBytes, err := json.Marshal(loop.meta)
+	if err != nil {
+		return err
+	}
+	loop.staged[metaKey] = metaBytes
+	return nil
+}
+
+// Write every state the current event changed in one batch, so that a crash keeps all of it or
+// none, such as a key's accepted value along with meta listing the key as accepted. Replies promise
+// what is in storage, so none go out until it is written, and it is tried again after the next event.
+func (loop *nodeLoop) commit() {
+	if len(loop.staged) == 0 {
+		return
+	}
+	if err := loop.storage.Batch(loop.staged); err != nil {
+		loop.network.stderrLogger.Print(err)
+		loop.outbox = map[string][][]byte{}
+		return
+	}
+	loop.staged = map[string][]byte{}
+}
+
+// Reply to the caller of Read or Write, if the operation started on this node
+func respond(msg *message, value []byte, err error) {
+	if msg.ResponseChan == nil {
+		return
+	}
+	// Both channels hold one reply, and any later reply to the same operation is dropped
+	select {
+	case msg.ResponseChan <- value:
+		msg.ErrChan <- err
+	default:
+	}
+}
+
+// Read a key. Returns nil when the value does not exist, and ErrUndecided when another node is in
+// the middle of writing it. Use context if you want a timeout or cancelation. A key is any bytes up
+// to MaxKeySize long, other than ones starting with a zero byte, which are reserved.
+func (node *Node) Read(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return node.do(ctx, node.readChan, &message{
+		Key: key,
+	})
+}
+
 // Write a value. Returns the value that belongs to the key, which may be different than what you
 // tried to write if the key was already written. Use context if you want a timeout or cancelation.
-func (node *Node) Write(ctx context.Context, key uint64, value []byte) ([]byte, error) {
+// Keys are the same as for Read.
+func (node *Node) Write(ctx context.Context, key string, value []byte) ([]byte, error) {
 	if value == nil {
 		return nil, &ErrNilValue{}
 	}
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return node.write(ctx, key, value)
+}
+
+// Write without checking the key, so the node can use reserved keys
+func (node *Node) write(ctx context.Context, key string, value []byte) ([]byte, error) {
+	return node.do(ctx, node.writeChan, &message{
+		Key:         key,
+		Value:       value,
+		Ctx:         ctx,
+		RetryPolicy: node.getRetryPolicy(),
+	})
+}
+
+// Hand an operation to the node's goroutine and wait for the result
+func (node *Node) do(ctx context.Context, channel chan<- *message, msg *message) ([]byte, error) {
 	respChan, errChan := make(chan []byte, 1), make(chan error, 1)
-	opID := newOpID()
-	go func() {
-		node.writeChan <- &message{
-			OpID:         opID,
-			Key:          key,
-			Value:        value,
-			ResponseChan: respChan,
-			ErrChan:      errChan,
-		}
-	}()
+	msg.OpID = newOpID()
+	msg.ResponseChan = respChan
+	msg.ErrChan = errChan
+	select {
+	case channel <- msg:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-node.life.done:
+		return nil, &ErrClosed{}
+	}
 	select {
 	case resp := <-respChan:
 		return resp, <-errChan
 	case <-ctx.Done():
-		go func() {
-			node.cleanChan <- opID
-		}()
+		node.clean(msg.OpID)
 		return nil, ctx.Err()
+	case <-node.life.done:
+		return nil, &ErrClosed{}
+	}
+}
+
+// Have the node's goroutine forget an operation the caller gave up on
+func (node *Node) clean(opID string) {
+	node.life.goroutine(func() {
+		select {
+		case node.cleanChan <- opID:
+		case <-node.life.done:
+		}
+	})
+}
+
+// What a read counts a response under. A value is only chosen once a quorum accepted it in the same
+// round, so the same value from different rounds is counted apart.
+type readKey struct {
+	N    ballot
+	Hash string
+}
+
+func newReadKey(msg *message) readKey {
+	hash := valueHash(msg)
+	if hash == "" {
+		return readKey{}
+	}
+	return readKey{N: msg.AcceptedN, Hash: hash}
+}
+
+// The quorum a read needs to hear the same thing from
+func (key readKey) phase() int {
+	switch {
+	case key.Hash == "":
+		return phase1
+	case key.N == fastBallot:
+		return fastPhase
 	}
+	return phase2
 }
 
 func getHash(value []byte) string {
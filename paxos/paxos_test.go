@@ -0,0 +1,412 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func addTestNodes(network *Network, n int) []*Node {
+	nodes := []*Node{}
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i), MemoryStorage()))
+	}
+	return nodes
+}
+
+// Every node reads the same value for a key, which is one of the values that were written
+func checkAgreement(ctx context.Context, t *testing.T, nodes []*Node, key string, written map[string]bool) {
+	values := map[string]bool{}
+	for _, node := range nodes {
+		value, err := node.Read(ctx, key)
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		values[string(value)] = true
+	}
+	if len(values) != 1 {
+		t.Fatalf("nodes read %v for %s", values, key)
+	}
+	for value := range values {
+		if !written[value] {
+			t.Fatalf("nodes read %q for %s, which nobody wrote", value, key)
+		}
+	}
+}
+
+func TestBallot(t *testing.T) {
+	tests := []struct {
+		json string
+		want ballot
+	}{
+		{`0`, ballot{}},
+		{`7`, ballot{Round: 7}}, // Stored before ballots existed
+		{`{"round":7,"nodeId":"n1"}`, ballot{Round: 7, NodeID: "n1"}},
+	}
+	for _, test := range tests {
+		b := ballot{}
+		if err := json.Unmarshal([]byte(test.json), &b); err != nil {
+			t.Fatal(err)
+		}
+		if b != test.want {
+			t.Fatalf("got %+v from %s, want %+v", b, test.json, test.want)
+		}
+	}
+	ordered := []ballot{{}, {Round: 1, NodeID: "n0"}, {Round: 1, NodeID: "n1"}, {Round: 2, NodeID: "n0"}}
+	for i := range ordered {
+		for j := range ordered {
+			if got := ordered[i].less(ordered[j]); got != (i < j) {
+				t.Fatalf("%+v less than %+v is %v", ordered[i], ordered[j], got)
+			}
+		}
+	}
+}
+
+func TestContention(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(network *Network)
+	}{
+		{"classic", func(network *Network) {}},
+		{"multi", func(network *Network) { network.SetMultiPaxos(true) }},
+		{"fast", func(network *Network) { network.SetFastPaxos(true) }},
+		{"lease", func(network *Network) {
+			network.SetMultiPaxos(true)
+			network.SetLeaseReads(true)
+		}},
+		{"binary codec", func(network *Network) { network.SetCodec(BinaryCodec()) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := NewNetwork()
+			defer network.Close(context.Background())
+			test.configure(network)
+			nodes := addTestNodes(network, 5)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			// Every node writes its own value to every key at once
+			keys := 10
+			wg := sync.WaitGroup{}
+			results := make([][][]byte, len(nodes)) // [node][key] value it got back
+			for i := range nodes {
+				results[i] = make([][]byte, keys)
+				for k := 0; k < keys; k++ {
+					wg.Add(1)
+					go func(i, k int) {
+						defer wg.Done()
+						value, err := nodes[i].Write(ctx, fmt.Sprint("k", k), []byte(fmt.Sprintf("n%d", i)))
+						if err != nil {
+							t.Errorf("n%d writing k%d: %v", i, k, err)
+						}
+						results[i][k] = value
+					}(i, k)
+				}
+			}
+			wg.Wait()
+			if t.Failed() {
+				return
+			}
+			written := map[string]bool{}
+			for i := range nodes {
+				written[fmt.Sprintf("n%d", i)] = true
+			}
+			for k := 0; k < keys; k++ {
+				for i := range nodes {
+					if string(results[i][k]) != string(results[0][k]) {
+						t.Fatalf("n0 got %q back for k%d, but n%d got %q", results[0][k], k, i, results[i][k])
+					}
+				}
+				checkAgreement(ctx, t, nodes, fmt.Sprint("k", k), written)
+			}
+		})
+	}
+}
+
+// A value that is final on one node and accepted on another was chosen, so a new leader that only
+// hears from the node where it is final still has to keep it
+func TestLeaderKeepsFinal(t *testing.T) {
+	accepted := &stateStruct{PromisedN: ballot{1, "n0"}, AcceptedN: ballot{1, "n0"}, Value: []byte("v")}
+	final := *accepted
+	final.Final = true
+	acceptedMeta, _ := json.Marshal(&metaStruct{Accepted: map[string]bool{"K": true}})
+	tests := []struct {
+		name    string
+		storage func() Storage // Of n0
+	}{
+		{"listing keys", func() Storage { return storageWith("K", &final) }},
+		{"not listing keys", func() Storage {
+			// Meta keeps every key it accepted, final or not, since storage cannot list them
+			storage := storageWith("K", &final)
+			storage.Put(metaKey, acceptedMeta)
+			return FuncStorage(&StorageFuncs{Get: storage.Get, Put: storage.Put})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := NewNetwork()
+			defer network.Close(context.Background())
+			network.SetMultiPaxos(true)
+			network.SetLoggers(log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+
+			// Only n2 gets to campaign, n1's promises get lost, and so does n0 telling anyone the
+			// value is final, which would otherwise only race the leader's phase 2
+			memory := MemoryTransport()
+			dropped := func(msgBytes []byte) bool {
+				msg, err := network.decodeMessage(msgBytes)
+				if err != nil {
+					return false
+				}
+				switch {
+				case msg.Type == leaderPrepareType && msg.Sender != "n2":
+					return true
+				case msg.Type == leaderPromiseType && msg.Sender == "n1":
+					return true
+				case msg.Type == finalType && msg.Sender == "n0":
+					return true
+				}
+				return false
+			}
+			network.SetTransport(FuncTransport(&TransportFuncs{
+				Send: func(ctx context.Context, id string, msgBytes []byte) error {
+					msg, err := network.decodeMessage(msgBytes)
+					if err != nil {
+						return err
+					}
+					for _, msgBytes2 := range msg.Batch {
+						if dropped(msgBytes2) {
+							return nil
+						}
+					}
+					if dropped(msgBytes) {
+						return nil
+					}
+					return memory.Send(ctx, id, msgBytes)
+				},
+				Listen: memory.Listen,
+			}))
+
+			n1Storage := storageWith("K", accepted)
+			n1Storage.Put(metaKey, acceptedMeta)
+			nodes := []*Node{
+				network.AddNode("n0", test.storage()),
+				network.AddNode("n1", n1Storage),
+				network.AddNode("n2", MemoryStorage()),
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			value, err := nodes[2].Write(ctx, "K", []byte("w"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != "v" {
+				t.Fatalf("leader wrote %q over the chosen value v", value)
+			}
+			checkAgreement(ctx, t, nodes, "K", map[string]bool{"v": true})
+		})
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	nodes := addTestNodes(NewNetwork(), 1)
+	for _, key := range []string{metaKey, reservedPrefix + "x"} {
+		if _, err := nodes[0].Write(context.Background(), key, []byte("x")); err == nil {
+			t.Fatalf("wrote reserved key %q", key)
+		} else if _, ok := err.(*ErrReservedKey); !ok {
+			t.Fatalf("got %v, want ErrReservedKey", err)
+		}
+		if _, err := nodes[0].Read(context.Background(), key); err == nil {
+			t.Fatalf("read reserved key %q", key)
+		}
+	}
+}
+
+func TestLongKeys(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 1)
+	key := strings.Repeat("x", MaxKeySize+1)
+	if _, err := nodes[0].Write(context.Background(), key, []byte("x")); err == nil {
+		t.Fatal("wrote a key longer than MaxKeySize")
+	} else if _, ok := err.(*ErrKeyTooLong); !ok {
+		t.Fatalf("got %v, want ErrKeyTooLong", err)
+	}
+	if _, err := nodes[0].Read(context.Background(), key); err == nil {
+		t.Fatal("read a key longer than MaxKeySize")
+	} else if _, ok := err.(*ErrKeyTooLong); !ok {
+		t.Fatalf("got %v, want ErrKeyTooLong", err)
+	}
+	dir, err := ioutil.TempDir("", "paxos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := DiskStorage(dir).Put(key, []byte("x")); err == nil {
+		t.Fatal("DiskStorage put a key longer than MaxKeySize")
+	} else if _, ok := err.(*ErrKeyTooLong); !ok {
+		t.Fatalf("got %v, want ErrKeyTooLong", err)
+	}
+}
+
+// Any bytes make a key, on disk as well as in memory
+func TestStringKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paxos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := []*Node{}
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("n%d", i)
+		nodes = append(nodes, network.AddNode(id, DiskStorage(path.Join(dir, id))))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	keys := []string{"", "a/b", "../c", "é", "\xff\x01", strings.Repeat("x", MaxKeySize)}
+	for i, key := range keys {
+		if _, err := nodes[i%3].Write(ctx, key, []byte(key+"!")); err != nil {
+			t.Fatalf("writing %q: %v", key, err)
+		}
+	}
+	for _, key := range keys {
+		checkAgreement(ctx, t, nodes, key, map[string]bool{key + "!": true})
+	}
+	keyValues, err := nodes[0].Scan(ctx, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	for i, keyValue := range keyValues {
+		if keyValue.Key != keys[i] {
+			t.Fatalf("scanned %q, want %q", keyValue.Key, keys[i])
+		}
+	}
+	if len(keyValues) != len(keys) {
+		t.Fatalf("scanned %d keys, want %d", len(keyValues), len(keys))
+	}
+}
+
+// Writes of different values that reach the acceptors in the fast round in different orders split
+// the vote, and the classic rounds after it still decide one of them
+func TestFastPaxosCollision(t *testing.T) {
+	for _, n := range []int{3, 5} {
+		t.Run(fmt.Sprint(n, " nodes"), func(t *testing.T) {
+			network := NewNetwork()
+			defer network.Close(context.Background())
+			network.SetFastPaxos(true)
+			nodes := addTestNodes(network, n)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			written := map[string]bool{}
+			for i := range nodes {
+				written[fmt.Sprintf("n%d", i)] = true
+			}
+			for k := 0; k < 20; k++ {
+				key := fmt.Sprint("k", k)
+				start := make(chan struct{})
+				values := make([][]byte, n)
+				wg := sync.WaitGroup{}
+				for i := range nodes {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						<-start
+						value, err := nodes[i].Write(ctx, key, []byte(fmt.Sprintf("n%d", i)))
+						if err != nil {
+							t.Errorf("n%d writing %s: %v", i, key, err)
+						}
+						values[i] = value
+					}(i)
+				}
+				close(start)
+				wg.Wait()
+				if t.Failed() {
+					return
+				}
+				for i := range values {
+					if string(values[i]) != string(values[0]) {
+						t.Fatalf("n0 got %q back for %s, but n%d got %q", values[0], key, i, values[i])
+					}
+				}
+				checkAgreement(ctx, t, nodes, key, written)
+			}
+		})
+	}
+}
+
+// Storage that holds a state for a key
+func storageWith(key string, state *stateStruct) Storage {
+	storage := MemoryStorage()
+	stateBytes, _ := json.Marshal(state)
+	storage.Put(key, stateBytes)
+	return storage
+}
+
+// A value is only chosen once a quorum accepted it in the same round
+func TestReadCountsBallots(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []*stateStruct // Of each node
+		want     string
+	}{
+		{"chosen", []*stateStruct{
+			{PromisedN: ballot{5, "a"}, AcceptedN: ballot{5, "a"}, Value: []byte("x")},
+			{PromisedN: ballot{5, "a"}, AcceptedN: ballot{5, "a"}, Value: []byte("x")},
+			{},
+		}, "x"},
+		// Any phase 1 quorum includes one of them, so a round recovers x
+		{"same value in different rounds", []*stateStruct{
+			{PromisedN: ballot{5, "a"}, AcceptedN: ballot{5, "a"}, Value: []byte("x")},
+			{PromisedN: ballot{6, "b"}, AcceptedN: ballot{6, "b"}, Value: []byte("x")},
+			{},
+		}, "x"},
+		{"nothing accepted", []*stateStruct{{}, {}, {}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := NewNetwork()
+			defer network.Close(context.Background())
+			nodes := []*Node{}
+			for i, state := range test.accepted {
+				nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i), storageWith("k1", state)))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i, node := range nodes {
+				value, err := node.Read(ctx, "k1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(value) != test.want {
+					t.Fatalf("n%d read %q, want %q", i, value, test.want)
+				}
+			}
+		})
+	}
+}
+
+// A read that cannot tell what was chosen, while another proposer keeps winning, says so rather
+// than make up an answer
+func TestReadUndecided(t *testing.T) {
+	nodes := addRivalNodes(NewNetwork(),
+		stateStruct{AcceptedN: ballot{1, "rival"}, Value: []byte("x")},
+		stateStruct{AcceptedN: ballot{2, "rival"}, Value: []byte("y")},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := nodes[0].Read(ctx, "k1")
+	if e, ok := err.(*ErrUndecided); !ok || e.Key != "k1" {
+		t.Fatalf("got %v, want ErrUndecided", err)
+	}
+}
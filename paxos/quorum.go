@@ -0,0 +1,146 @@
+package paxos
+
+const (
+	phase1    = iota + 1 // Promises, and reads that find nothing
+	phase2               // Accepts, and reads that find a value
+	fastPhase            // Accepts in the fast round, and reads that find a value from it
+)
+
+// Set how much weight phase 1 and phase 2 each need to hear from, zero meaning more than half of
+// the total. Any phase 1 quorum has to overlap with any phase 2 quorum, so phase1+phase2 must be
+// more than the total weight of the members. Call it after adding every node and setting weights,
+// since members added later that break that rule stop every quorum from being reached.
+func (network *Network) SetQuorums(phase1, phase2 int) error {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	old1, old2 := network.phase1Quorum, network.phase2Quorum
+	network.phase1Quorum, network.phase2Quorum = phase1, phase2
+	if err := network.checkQuorumsLocked(network.firstMembersLocked()); err != nil {
+		network.phase1Quorum, network.phase2Quorum = old1, old2
+		return err
+	}
+	return nil
+}
+
+// Set how much a node's vote counts, 1 unless set. It must be the same on every node, and the
+// quorums have to work with it once nodes are added.
+func (network *Network) SetWeight(id string, weight int) error {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	old, ok := network.weights[id]
+	network.weights[id] = weight
+	err := error(nil)
+	if weight < 0 {
+		err = &ErrInvalidWeight{ID: id, Weight: weight}
+	} else if members := network.firstMembersLocked(); 0 < len(members) {
+		err = network.checkQuorumsLocked(members)
+	}
+	if err != nil {
+		if ok {
+			network.weights[id] = old
+		} else {
+			delete(network.weights, id)
+		}
+	}
+	return err
+}
+
+// Count a node as one of the first members. Quorums set for fewer members may no longer overlap, in
+// which case nothing is decided until SetQuorums fixes them.
+func (network *Network) addMember(id string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.members[id] = struct{}{}
+	if err := network.checkQuorumsLocked(network.firstMembersLocked()); err != nil {
+		network.stderrLogger.Printf("Adding %s: %v", id, err)
+	}
+}
+
+// Whether the quorums work with these members
+func (network *Network) checkQuorums(members []string) error {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.checkQuorumsLocked(members)
+}
+
+func (network *Network) checkQuorumsLocked(members []string) error {
+	total := network.totalWeightLocked(members)
+	q1, q2 := network.quorumSizeLocked(total, phase1), network.quorumSizeLocked(total, phase2)
+	if q1 < 1 || q2 < 1 || total < q1 || total < q2 || q1+q2 <= total {
+		return &ErrInvalidQuorums{Phase1: q1, Phase2: q2, Weight: total}
+	}
+	return nil
+}
+
+func (network *Network) totalWeightLocked(members []string) int {
+	total := 0
+	for _, id := range members {
+		total += network.weightLocked(id)
+	}
+	return total
+}
+
+func (network *Network) weightLocked(id string) int {
+	if weight, ok := network.weights[id]; ok {
+		return weight
+	}
+	return 1
+}
+
+// How much weight out of total makes a quorum for a phase
+func (network *Network) quorumSizeLocked(total, phase int) int {
+	if phase == fastPhase {
+		// Any two fast quorums and a phase 1 quorum have to share a node
+		return (2*total-network.quorumSizeLocked(total, phase1))/2 + 1
+	}
+	size := network.phase1Quorum
+	if phase == phase2 {
+		size = network.phase2Quorum
+	}
+	if size == 0 {
+		size = total/2 + 1
+	}
+	return size
+}
+
+// Whether ids include a quorum of members for a phase
+func (network *Network) isQuorum(members []string, ids map[string]struct{}, phase int) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if network.checkQuorumsLocked(members) != nil {
+		// Quorums that may not overlap could decide two values, so they decide nothing
+		return false
+	}
+	weight := 0
+	for _, id := range members {
+		if _, ok := ids[id]; ok {
+			weight += network.weightLocked(id)
+		}
+	}
+	return network.quorumSizeLocked(network.totalWeightLocked(members), phase) <= weight
+}
+
+// Whether ids include a quorum for a phase in every set of members. Anything that can choose a
+// value needs a member that keeps it, rather than only witnesses.
+func (loop *nodeLoop) isQuorum(ids map[string]struct{}, phase int) bool {
+	if phase != phase1 && !loop.hasReplica(ids) {
+		return false
+	}
+	for _, members := range loop.quorumSets() {
+		if !loop.network.isQuorum(members, ids, phase) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the members that are no longer being waited on make a quorum for a phase
+func (loop *nodeLoop) quorumResponded(waitingMap map[string]struct{}, phase int) bool {
+	responded := map[string]struct{}{}
+	for id := range loop.members() {
+		if _, ok := waitingMap[id]; !ok {
+			responded[id] = struct{}{}
+		}
+	}
+	return loop.isQuorum(responded, phase)
+}
@@ -0,0 +1,152 @@
+package paxos
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestSetQuorums(t *testing.T) {
+	tests := []struct {
+		phase1, phase2 int
+		ok             bool
+	}{
+		{0, 0, true}, // Majorities
+		{3, 3, true},
+		{1, 5, true},
+		{4, 2, true},
+		{2, 2, false}, // Two quorums of two out of five need not overlap
+		{0, 2, false},
+		{6, 1, false},
+		{-1, 5, false},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, test := range tests {
+		network := NewNetwork()
+		defer network.Close(context.Background())
+		nodes := addTestNodes(network, 5)
+		err := network.SetQuorums(test.phase1, test.phase2)
+		if _, invalid := err.(*ErrInvalidQuorums); test.ok && err != nil || !test.ok && !invalid {
+			t.Fatalf("got %v setting quorums %d and %d", err, test.phase1, test.phase2)
+		}
+		if !test.ok {
+			continue
+		}
+		if _, err := nodes[0].Write(ctx, "k1", []byte("x")); err != nil {
+			t.Fatalf("writing with quorums %d and %d: %v", test.phase1, test.phase2, err)
+		}
+		if value, err := nodes[4].Read(ctx, "k1"); err != nil || string(value) != "x" {
+			t.Fatalf("read %q, %v with quorums %d and %d", value, err, test.phase1, test.phase2)
+		}
+	}
+}
+
+// Quorums that are refused leave the old ones in place
+func TestSetQuorumsKeepsOld(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	addTestNodes(network, 5)
+	if err := network.SetQuorums(2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.SetQuorums(2, 2); err == nil {
+		t.Fatal("set quorums that do not overlap")
+	}
+	if q1, q2 := network.quorumSizeLocked(5, phase1), network.quorumSizeLocked(5, phase2); q1 != 2 || q2 != 4 {
+		t.Fatalf("got quorums %d and %d, want 2 and 4", q1, q2)
+	}
+}
+
+// A member is only added if the quorums still overlap with it
+func TestAddMemberChecksQuorums(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	if err := network.SetQuorums(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	network.AddNewNode("n3", MemoryStorage())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := nodes[0].AddMember(ctx, "n3"); err == nil {
+		t.Fatal("added a fourth member with quorums of two")
+	} else if _, ok := err.(*ErrInvalidQuorums); !ok {
+		t.Fatalf("got %v, want ErrInvalidQuorums", err)
+	}
+}
+
+// A node added after quorums were set can leave them too small to overlap, which decides nothing
+// rather than risk deciding two values
+func TestAddNodeBreaksQuorums(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetLoggers(log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	nodes := addTestNodes(network, 3)
+	if err := network.SetQuorums(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	network.AddNode("n3", MemoryStorage())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err := nodes[0].Write(ctx, "k", []byte("x"))
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v writing with quorums that do not overlap, want %v", err, context.DeadlineExceeded)
+	}
+	if err := network.SetQuorums(2, 3); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if value, err := nodes[1].Write(ctx, "k", []byte("y")); err != nil || string(value) != "y" {
+		t.Fatalf("wrote %q, %v", value, err)
+	}
+}
+
+func TestSetWeight(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	addTestNodes(network, 5)
+	if err := network.SetWeight("n0", -1); err == nil {
+		t.Fatal("set a negative weight")
+	} else if _, ok := err.(*ErrInvalidWeight); !ok {
+		t.Fatalf("got %v, want ErrInvalidWeight", err)
+	}
+	if err := network.SetQuorums(3, 3); err != nil {
+		t.Fatal(err)
+	}
+	// A total weight of 7 is too much for quorums of 3, so the weight stays as it was
+	if err := network.SetWeight("n0", 3); err == nil {
+		t.Fatal("set a weight the quorums do not fit")
+	} else if _, ok := err.(*ErrInvalidQuorums); !ok {
+		t.Fatalf("got %v, want ErrInvalidQuorums", err)
+	}
+	if weight := network.weightLocked("n0"); weight != 1 {
+		t.Fatalf("n0 has weight %d, want 1", weight)
+	}
+}
+
+// A node that carries most of the weight is a quorum by itself, even when nobody else answers
+func TestWeightedQuorum(t *testing.T) {
+	for _, weight := range []int{1, 3} {
+		network := NewNetwork()
+		defer network.Close(context.Background())
+		node := network.AddNode("n0", MemoryStorage())
+		for _, id := range []string{"n1", "n2"} {
+			network.AddRemoteNode(id) // Nothing listens for it, like a node that is down
+		}
+		if err := network.SetWeight("n0", weight); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := node.Write(ctx, "k1", []byte("x"))
+		cancel()
+		if weight == 1 && err != context.DeadlineExceeded {
+			t.Fatalf("got %v writing without a quorum, want %v", err, context.DeadlineExceeded)
+		} else if weight == 3 && err != nil {
+			t.Fatalf("got %v writing with weight %d", err, weight)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package paxos
+
+import (
+	"time"
+)
+
+const (
+	defaultResendTimeout = time.Second
+	maxResendDoublings   = 5 // Each resend waits twice as long as the last, up to this many times
+)
+
+// A request that is still waiting on replies
+type pendingStruct struct {
+	msg     *message
+	sent    time.Time
+	resends int
+}
+
+// Messages can get lost, so each request is sent again to the nodes that have not replied once it
+// waits this long, and again after twice as long, and so on. A node that is busy replying to older
+// requests is left alone. Every request can be answered more than once, so a round goes on where
+// it left off rather than starting over, except that a fast round falls back to a classic one.
+// Zero turns it off. It must be set before any nodes are added.
+func (network *Network) SetResendTimeout(timeout time.Duration) {
+	network.resendAfter = timeout
+}
+
+// Remember a request that was just sent, so it goes out again if replies are slow to come
+func (loop *nodeLoop) expect(msg *message) {
+	loop.pendingMap[msg.OpID] = &pendingStruct{
+		msg:  msg,
+		sent: time.Now(),
+	}
+}
+
+// The nodes a request still waits on, and false once it waits on nothing. Each kind of request
+// keeps them in its own map.
+func (loop *nodeLoop) waitingFor(msg *message) (map[string]struct{}, bool) {
+	switch msg.Type {
+	case write1RequestType:
+		waitingMap, ok := loop.write1WaitingMap[msg.OpID][msg.N]
+		return waitingMap, ok
+	case write2RequestType:
+		waitingMap, ok := loop.write2WaitingMap[msg.OpID][msg.N]
+		return waitingMap, ok
+	case fastRequestType:
+		waitingMap, ok := loop.fastWaitingMap[msg.OpID]
+		return waitingMap, ok
+	case readRequestType:
+		waitingMap, ok := loop.readWaitingMap[msg.OpID]
+		return waitingMap, ok
+	case keysRequestType:
+		waitingMap, ok := loop.keysWaitingMap[msg.OpID]
+		return waitingMap, ok
+	case installType:
+		waitingMap, ok := loop.installWaitingMap[msg.OpID]
+		return waitingMap, ok
+	case forwardType:
+		// Sent to whichever node leads now
+		if _, ok := loop.leader.forwarded[msg.OpID]; ok && loop.leader.id != "" {
+			return map[string]struct{}{loop.leader.id: {}}, true
+		}
+	case valueRequestType:
+		if fetch, ok := loop.fetchMap[msg.OpID]; ok && fetch.key == msg.Key {
+			return fetch.waitingMap, true
+		}
+	}
+	return nil, false
+}
+
+// Send every request that timed out again to the nodes that have not replied
+func (loop *nodeLoop) resend() {
+	now := time.Now()
+	for opID, pending := range loop.pendingMap {
+		waitingMap, ok := loop.waitingFor(pending.msg)
+		if !ok {
+			delete(loop.pendingMap, opID)
+			continue
+		}
+		doublings := pending.resends
+		if maxResendDoublings < doublings {
+			doublings = maxResendDoublings
+		}
+		timeout := loop.network.resendAfter << doublings
+		if now.Sub(pending.sent) < timeout {
+			continue
+		}
+		if pending.msg.Type == fastRequestType {
+			// A classic round needs fewer nodes to reply, so it is less likely to wait on a lost
+			// message
+			loop.fallBack(opID)
+			continue
+		}
+		ids := map[string]struct{}{}
+		for id := range waitingMap {
+			if id == loop.id {
+				continue // Nothing sent to itself gets lost
+			}
+			// Replies come back in about the order requests went out, so a node that answered a
+			// later request or went quiet lost this one, while one still answering earlier ones is
+			// only slow
+			if pending.sent.Before(loop.repliedTo[id]) || loop.network.resendAfter <= now.Sub(loop.repliedAt[id]) {
+				ids[id] = struct{}{}
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		pending.sent = now
+		pending.resends++
+		loop.multicast(ids, pending.msg)
+	}
+}
+
+// Note when a node replied to a request, which tells resend whether the node is keeping up
+func (loop *nodeLoop) heardReply(msg *message) {
+	pending, ok := loop.pendingMap[msg.OpID]
+	if !ok {
+		return
+	}
+	if waitingMap, ok := loop.waitingFor(pending.msg); !ok {
+		return
+	} else if _, ok := waitingMap[msg.Sender]; !ok {
+		return
+	}
+	loop.repliedAt[msg.Sender] = time.Now()
+	if loop.repliedTo[msg.Sender].Before(pending.sent) {
+		loop.repliedTo[msg.Sender] = pending.sent
+	}
+}
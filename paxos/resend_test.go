@@ -0,0 +1,78 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Memory transport that drops a share of the messages between nodes, as if they got lost
+func lossyTransport(loss float64) Transport {
+	memory := MemoryTransport()
+	mutex := sync.Mutex{}
+	random := rand.New(rand.NewSource(1))
+	return FuncTransport(&TransportFuncs{
+		Send: func(ctx context.Context, id string, msgBytes []byte) error {
+			mutex.Lock()
+			lost := random.Float64() < loss
+			mutex.Unlock()
+			if lost {
+				return nil
+			}
+			return memory.Send(ctx, id, msgBytes)
+		},
+		Listen: memory.Listen,
+	})
+}
+
+func TestResend(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(network *Network)
+	}{
+		{"classic", func(network *Network) {}},
+		{"multi", func(network *Network) { network.SetMultiPaxos(true) }},
+		{"fast", func(network *Network) { network.SetFastPaxos(true) }},
+		{"binary codec", func(network *Network) { network.SetCodec(BinaryCodec()) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network := NewNetwork()
+			defer network.Close(context.Background())
+			discard := log.New(ioutil.Discard, "", 0)
+			network.SetLoggers(discard, discard)
+			network.SetResendTimeout(20 * time.Millisecond)
+			test.configure(network)
+			network.SetTransport(lossyTransport(0.2))
+			nodes := addTestNodes(network, 3)
+
+			// Far less time than backing off and retrying whole rounds would take
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			wg := sync.WaitGroup{}
+			for i := range nodes {
+				for k := 0; k < 5; k++ {
+					wg.Add(1)
+					go func(i int, key string) {
+						defer wg.Done()
+						if _, err := nodes[i].Write(ctx, key, []byte(fmt.Sprintf("n%d", i))); err != nil {
+							t.Errorf("n%d writing %s: %v", i, key, err)
+						}
+					}(i, fmt.Sprint("k", k))
+				}
+			}
+			wg.Wait()
+			if t.Failed() {
+				return
+			}
+			for k := 0; k < 5; k++ {
+				checkAgreement(ctx, t, nodes, fmt.Sprint("k", k), map[string]bool{"n0": true, "n1": true, "n2": true})
+			}
+		})
+	}
+}
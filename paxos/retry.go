@@ -0,0 +1,69 @@
+package paxos
+
+import (
+	"math/rand"
+	"time"
+)
+
+// How a node retries a write after another proposer beats it. Waits grow exponentially with some
+// randomness so that competing proposers stop colliding.
+type RetryPolicy struct {
+	InitialBackoff time.Duration // Wait before the first retry
+	MaxBackoff     time.Duration // Waits never grow past this
+	Multiplier     float64       // Each wait is this much longer than the last
+	Jitter         float64       // Fraction of each wait that is random, between 0 and 1
+	MaxAttempts    int           // Give up after this many rounds, zero means never give up
+}
+
+// Used by nodes unless SetRetryPolicy says otherwise
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// How long to wait before the given retry, counting from 1
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	wait := float64(policy.InitialBackoff)
+	for i := 1; i < retry && wait < float64(policy.MaxBackoff); i++ {
+		wait *= policy.Multiplier
+	}
+	if max := float64(policy.MaxBackoff); 0 < max && max < wait {
+		wait = max
+	}
+	wait -= wait * policy.Jitter * rand.Float64()
+	return time.Duration(wait)
+}
+
+// Set how writes are retried when another proposer gets in the way. Applies to writes that start
+// after it is called. The zero RetryPolicy means DefaultRetryPolicy. Any other policy is taken as it
+// is, so a Jitter of zero means none, and one that could wait less than no time is refused.
+func (node *Node) SetRetryPolicy(policy RetryPolicy) error {
+	if policy == (RetryPolicy{}) {
+		policy = DefaultRetryPolicy
+	}
+	switch {
+	case policy.InitialBackoff < 0:
+		return &ErrInvalidRetryPolicy{Field: "InitialBackoff"}
+	case policy.MaxBackoff < policy.InitialBackoff:
+		return &ErrInvalidRetryPolicy{Field: "MaxBackoff"}
+	case policy.Multiplier < 1:
+		return &ErrInvalidRetryPolicy{Field: "Multiplier"}
+	case policy.Jitter < 0 || 1 < policy.Jitter:
+		return &ErrInvalidRetryPolicy{Field: "Jitter"}
+	case policy.MaxAttempts < 0:
+		return &ErrInvalidRetryPolicy{Field: "MaxAttempts"}
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.retryPolicy = policy
+	return nil
+}
+
+func (node *Node) getRetryPolicy() *RetryPolicy {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	policy := node.retryPolicy
+	return &policy
+}
@@ -0,0 +1,158 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Multiplier:     2,
+	}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{5, 100 * time.Millisecond},
+		{50, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := policy.backoff(test.retry); got != test.want {
+			t.Fatalf("waited %v before retry %d, want %v", got, test.retry, test.want)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.backoff(3); got < 20*time.Millisecond || 40*time.Millisecond < got {
+			t.Fatalf("waited %v with jitter, want between 20ms and 40ms", got)
+		}
+	}
+}
+
+// Storage of an acceptor that a rival proposer always gets to first, with a higher ballot each time.
+// Keys that were never put hold whatever the rival had accepted.
+func rivalStorage(accepted stateStruct) Storage {
+	storage := MemoryStorage()
+	mutex := sync.Mutex{}
+	round := uint64(1 << 40)
+	return FuncStorage(&StorageFuncs{
+		Get: func(key string) ([]byte, error) {
+			value, err := storage.Get(key)
+			if err != nil || value != nil {
+				return value, err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			round += 1 << 20
+			state := accepted
+			state.PromisedN = ballot{Round: round, NodeID: "rival"}
+			return json.Marshal(&state)
+		},
+		Put: func(key string, value []byte) error {
+			return nil // The rival's promise stands
+		},
+	})
+}
+
+// A node of its own, then a node for each of the rival's acceptors
+func addRivalNodes(network *Network, accepted ...stateStruct) []*Node {
+	if len(accepted) == 0 {
+		accepted = []stateStruct{{}, {}}
+	}
+	nodes := []*Node{network.AddNode("n0", MemoryStorage())}
+	for i, state := range accepted {
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i+1), rivalStorage(state)))
+	}
+	return nodes
+}
+
+func TestMaxAttempts(t *testing.T) {
+	nodes := addRivalNodes(NewNetwork())
+	err := nodes[0].SetRetryPolicy(RetryPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Multiplier:     2,
+		MaxAttempts:    3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = nodes[0].Write(ctx, "k1", []byte("x"))
+	if e, ok := err.(*ErrMaxAttempts); !ok || e.Attempts != 3 {
+		t.Fatalf("got %v, want ErrMaxAttempts after 3 attempts", err)
+	}
+}
+
+// A long wait before a retry ends as soon as the caller's context does
+func TestRetryRespectsContext(t *testing.T) {
+	nodes := addRivalNodes(NewNetwork())
+	if err := nodes[0].SetRetryPolicy(RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour, Multiplier: 2}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := nodes[0].Write(ctx, "k1", []byte("x")); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); time.Second < elapsed {
+		t.Fatalf("took %v to give up", elapsed)
+	}
+}
+
+func TestSetRetryPolicy(t *testing.T) {
+	tests := []struct {
+		policy  RetryPolicy
+		want    RetryPolicy
+		invalid string // Field that is refused
+	}{
+		{RetryPolicy{}, DefaultRetryPolicy, ""},
+		// Other policies are taken as they are, with no jitter and no limit on attempts here
+		{RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}, RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Multiplier:     1,
+		}, ""},
+		{RetryPolicy{MaxBackoff: time.Second, Multiplier: 3, Jitter: 1, MaxAttempts: 5}, RetryPolicy{
+			MaxBackoff:  time.Second,
+			Multiplier:  3,
+			Jitter:      1,
+			MaxAttempts: 5,
+		}, ""},
+		{RetryPolicy{MaxAttempts: 5}, RetryPolicy{}, "Multiplier"},
+		{RetryPolicy{InitialBackoff: time.Minute, Multiplier: 2}, RetryPolicy{}, "MaxBackoff"},
+		{RetryPolicy{InitialBackoff: -1, Multiplier: 2}, RetryPolicy{}, "InitialBackoff"},
+		{RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Millisecond, Multiplier: 2}, RetryPolicy{}, "MaxBackoff"},
+		{RetryPolicy{Multiplier: 0.5}, RetryPolicy{}, "Multiplier"},
+		{RetryPolicy{Multiplier: 2, Jitter: 1.5}, RetryPolicy{}, "Jitter"},
+		{RetryPolicy{Multiplier: 2, Jitter: -0.5}, RetryPolicy{}, "Jitter"},
+		{RetryPolicy{Multiplier: 2, MaxAttempts: -1}, RetryPolicy{}, "MaxAttempts"},
+	}
+	nodes := addTestNodes(NewNetwork(), 1)
+	for _, test := range tests {
+		err := nodes[0].SetRetryPolicy(test.policy)
+		if test.invalid != "" {
+			if e, ok := err.(*ErrInvalidRetryPolicy); !ok || e.Field != test.invalid {
+				t.Fatalf("got %v setting %+v, want %s refused", err, test.policy, test.invalid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("got %v setting %+v", err, test.policy)
+		}
+		if got := *nodes[0].getRetryPolicy(); got != test.want {
+			t.Fatalf("set %+v and got %+v, want %+v", test.policy, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// A key and the value decided for it
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Read many keys at once. Returns the value of each key, nil for those that do not exist, or the
+// first error any read runs into.
+func (node *Node) ReadMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	msgs := []*message{}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &message{
+			Key: key,
+		})
+	}
+	values := map[string][]byte{}
+	for i, result := range node.doBatch(ctx, node.readsChan, msgs) {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		values[msgs[i].Key] = result.Value
+	}
+	return values, nil
+}
+
+// Every key from from up to but not including to that has a value, in byte order, and at most limit
+// of them unless limit is zero. An empty to scans to the last key. Needs storage that can list its
+// keys on every member. Keys that cannot be read, such as ones with a write in progress, are left
+// out, and reported with ErrSkippedKeys along with every key that could be read.
+func (node *Node) Scan(ctx context.Context, from, to string, limit int) ([]*KeyValue, error) {
+	keyValues := []*KeyValue{}
+	skipped := &ErrSkippedKeys{}
+	for {
+		// Members list only as many keys as are still wanted
+		wanted := 0
+		if 0 < limit {
+			wanted = limit - len(keyValues)
+		}
+		keys, err := node.keys(ctx, from, to, wanted)
+		if err != nil {
+			return nil, err
+		}
+		listed := len(keys)
+		if 0 < listed {
+			from = keys[listed-1] + "\x00"
+		}
+		for 0 < len(keys) {
+			// Some keys were only proposed and have no value, so keep going until there are enough
+			size := len(keys)
+			if 0 < limit && limit-len(keyValues) < size {
+				size = limit - len(keyValues)
+			}
+			msgs := []*message{}
+			for _, key := range keys[:size] {
+				msgs = append(msgs, &message{Key: key})
+			}
+			for i, result := range node.doBatch(ctx, node.readsChan, msgs) {
+				if result.Err != nil {
+					skipped.skip(msgs[i].Key, result.Err)
+				} else if result.Value != nil {
+					keyValues = append(keyValues, &KeyValue{Key: msgs[i].Key, Value: result.Value})
+				}
+			}
+			keys = keys[size:]
+			if 0 < limit && limit <= len(keyValues) {
+				break
+			}
+			if ctx.Err() != nil {
+				for _, key := range keys {
+					skipped.skip(key, ctx.Err())
+				}
+				break
+			}
+		}
+		// Members that listed as many keys as they were asked for may have more after them
+		if limit == 0 || limit <= len(keyValues) || listed < wanted || ctx.Err() != nil {
+			return keyValues, skipped.result()
+		}
+	}
+}
+
+// Every key in a range that any member has state for, in order. A quorum of members has every key
+// that could have been decided, along with some that were only proposed. With a limit, each member
+// lists at most that many, and keys past the last one of a member that hit the limit are left out.
+func (node *Node) keys(ctx context.Context, from, to string, limit int) ([]string, error) {
+	keysBytes, err := node.do(ctx, node.opChan, &message{
+		Type:  keysRequestType,
+		From:  from,
+		To:    to,
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keysJSON := []jsonKey{}
+	if err := json.Unmarshal(keysBytes, &keysJSON); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, key := range keysJSON {
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// Whether a key is from from up to but not including to, where an empty to has no end
+func inRange(key, from, to string) bool {
+	return from <= key && (to == "" || key < to)
+}
@@ -0,0 +1,205 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadMany(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := nodes[0].Write(ctx, key, []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err := nodes[1].ReadMany(ctx, []string{"a", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a": []byte("valuea"), "c": []byte("valuec"), "d": nil}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("got %q, want %q", values, want)
+	}
+	if _, err := nodes[1].ReadMany(ctx, []string{"a", metaKey}); err == nil {
+		t.Fatal("read a reserved key")
+	} else if _, ok := err.(*ErrReservedKey); !ok {
+		t.Fatalf("got %v, want ErrReservedKey", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := []*Node{}
+	for i := 0; i < 3; i++ {
+		// Key b2 was only ever promised, so it has state but no value
+		storage := storageWith("b2", &stateStruct{PromisedN: ballot{1, "n0"}})
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i), storage))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, key := range []string{"a", "b", "b1", "b3", "c"} {
+		if _, err := nodes[i%3].Write(ctx, key, []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		from, to string
+		limit    int
+		want     []string
+	}{
+		{"", "", 0, []string{"a", "b", "b1", "b3", "c"}},
+		{"", "z", 0, []string{"a", "b", "b1", "b3", "c"}},
+		{"b", "c", 0, []string{"b", "b1", "b3"}},
+		{"b0", "", 0, []string{"b1", "b3", "c"}},
+		{"", "", 2, []string{"a", "b"}},
+		{"b1", "", 2, []string{"b1", "b3"}}, // Past the key without a value
+		{"", "", 10, []string{"a", "b", "b1", "b3", "c"}},
+		{"d", "", 0, []string{}},
+	}
+	for _, test := range tests {
+		keyValues, err := nodes[1].Scan(ctx, test.from, test.to, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, keyValue := range keyValues {
+			if string(keyValue.Value) != "value"+keyValue.Key {
+				t.Fatalf("got %q for %s", keyValue.Value, keyValue.Key)
+			}
+			keys = append(keys, keyValue.Key)
+		}
+		if !reflect.DeepEqual(keys, test.want) {
+			t.Fatalf("scanning %q to %q with limit %d got %v, want %v", test.from, test.to, test.limit, keys, test.want)
+		}
+	}
+}
+
+// Storage that lists its keys, where one key belongs to a rival proposer like in rivalStorage
+type rivalKeyStorage struct {
+	Storage
+	key   string
+	rival Storage
+}
+
+func (s *rivalKeyStorage) Get(key string) ([]byte, error) {
+	if key == s.key {
+		return s.rival.Get(key)
+	}
+	return s.Storage.Get(key)
+}
+
+func (s *rivalKeyStorage) Batch(writes map[string][]byte) error {
+	writes2 := map[string][]byte{}
+	for key, value := range writes {
+		if key != s.key {
+			writes2[key] = value
+		}
+	}
+	return s.Storage.Batch(writes2)
+}
+
+// A key that cannot be read leaves out only that key
+func TestScanSkipsKeys(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := []*Node{network.AddNode("n0", MemoryStorage())}
+	for i, value := range []string{"x", "y"} {
+		// Listed under b, which the rival keeps from being decided
+		storage := storageWith("b", &stateStruct{})
+		rival := rivalStorage(stateStruct{AcceptedN: ballot{uint64(i + 1), "rival"}, Value: []byte(value)})
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i+1), &rivalKeyStorage{storage, "b", rival}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range []string{"a", "c"} {
+		if _, err := nodes[0].Write(ctx, key, []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyValues, err := nodes[0].Scan(ctx, "", "", 0)
+	skipped, ok := err.(*ErrSkippedKeys)
+	if !ok || !reflect.DeepEqual(skipped.Keys, []string{"b"}) {
+		t.Fatalf("got %v, want b skipped", err)
+	}
+	if _, ok := skipped.Errs[0].(*ErrUndecided); !ok {
+		t.Fatalf("got %v, want ErrUndecided", skipped.Errs[0])
+	}
+	keys := []string{}
+	for _, keyValue := range keyValues {
+		keys = append(keys, keyValue.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Fatalf("got %v, want a and c", keys)
+	}
+}
+
+// Members list no more keys than a scan wants, rather than every key in the range
+func TestScanLimitsMembers(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	memory := MemoryTransport()
+	mutex := sync.Mutex{}
+	listed := 0 // Most keys any member listed at once
+	count := func(msgBytes []byte) {
+		if msg, err := network.decodeMessage(msgBytes); err == nil && msg.Type == keysResponseType {
+			mutex.Lock()
+			if listed < len(msg.Keys) {
+				listed = len(msg.Keys)
+			}
+			mutex.Unlock()
+		}
+	}
+	network.SetTransport(FuncTransport(&TransportFuncs{
+		Send: func(ctx context.Context, id string, msgBytes []byte) error {
+			if msg, err := network.decodeMessage(msgBytes); err == nil {
+				for _, msgBytes2 := range msg.Batch {
+					count(msgBytes2)
+				}
+			}
+			count(msgBytes)
+			return memory.Send(ctx, id, msgBytes)
+		},
+		Listen: memory.Listen,
+	}))
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	values := map[string][]byte{}
+	for k := 10; k < 30; k++ {
+		values[fmt.Sprint("k", k)] = []byte("x")
+	}
+	results, err := nodes[0].WriteBatch(ctx, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, result := range results {
+		if result.Err != nil {
+			t.Fatalf("writing %s: %v", key, result.Err)
+		}
+	}
+	keyValues, err := nodes[1].Scan(ctx, "k15", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, keyValue := range keyValues {
+		got = append(got, keyValue.Key)
+	}
+	if want := []string{"k15", "k16", "k17"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if listed != 3 {
+		t.Fatalf("members listed up to %d keys, want 3", listed)
+	}
+}
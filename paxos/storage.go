@@ -1,60 +1,638 @@
 package paxos
 
 import (
-	"fmt"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// Keys that start with this are kept for the node's own bookkeeping, so Read and Write refuse them
+const (
+	reservedPrefix = "\x00"
+	metaKey        = reservedPrefix + "meta"
+)
+
+func isReserved(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+// Longest key in bytes, so that DiskStorage can name a file after any key in hex
+const MaxKeySize = 120
+
+// Whether Read and Write take a key, which has to be short enough and not reserved
+func checkKey(key string) error {
+	if isReserved(key) {
+		return &ErrReservedKey{Key: key}
+	}
+	if MaxKeySize < len(key) {
+		return &ErrKeyTooLong{Key: key}
+	}
+	return nil
+}
+
 // Storage is for persisting state, since nodes support failure. No need to implement your own
 // mutexes since nodes are already thread safe.
-type Storage struct {
-	Get func(key uint64) (value []byte, _ error)
-	Put func(key uint64, value []byte) error
-}
-
-// Durable storage on disk
-func DiskStorage(dir string) *Storage {
-	fname := func(key uint64) string {
-		return path.Join(dir, fmt.Sprintf("%d.json", key))
-	}
-	return &Storage{
-		Get: func(key uint64) ([]byte, error) {
-			value, err := ioutil.ReadFile(fname(key))
-			if os.IsNotExist(err) {
-				return value, nil
-			}
-			return value, err
-		},
-		Put: func(key uint64, value []byte) error {
-			err := os.MkdirAll(dir, 0700)
+type Storage interface {
+	Get(key string) (value []byte, _ error) // Nil if the key has no value
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// Call f with every key from up to but not including to, in byte order, until f returns false. An
+	// empty to goes to the last key. Keys that cannot be read are skipped, and reported with
+	// ErrSkippedKeys once the rest are done.
+	Iterate(from, to string, f func(key string, value []byte) bool) error
+	// Put every value of {key: value} and delete every key whose value is nil, all or none of them
+	// even on a crash
+	Batch(writes map[string][]byte) error
+	Sync() error  // Make every write so far durable
+	Close() error // Called once the node closes
+}
+
+// Note a key that Iterate or Scan could not read
+func (e *ErrSkippedKeys) skip(key string, err error) {
+	e.Keys = append(e.Keys, key)
+	e.Errs = append(e.Errs, err)
+}
+
+// What Iterate or Scan returns, nil unless it skipped a key
+func (e *ErrSkippedKeys) result() error {
+	if len(e.Keys) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Storage the way it used to be, before it was an interface. FuncStorage adapts it.
+type StorageFuncs struct {
+	Get  func(key string) (value []byte, _ error)
+	Put  func(key string, value []byte) error
+	Keys func() ([]string, error) // Every key that was put, only needed to change members, scan and read with leases
+}
+
+// Storage made of funcs. Deleting a key puts nil, and a batch puts one key at a time, so a crash can
+// leave only some of it written.
+func FuncStorage(funcs *StorageFuncs) Storage {
+	return &funcStorage{funcs}
+}
+
+type funcStorage struct {
+	funcs *StorageFuncs
+}
+
+func (s *funcStorage) Get(key string) ([]byte, error) {
+	return s.funcs.Get(key)
+}
+
+func (s *funcStorage) Put(key string, value []byte) error {
+	return s.funcs.Put(key, value)
+}
+
+func (s *funcStorage) Delete(key string) error {
+	return s.funcs.Put(key, nil)
+}
+
+func (s *funcStorage) Iterate(from, to string, f func(key string, value []byte) bool) error {
+	if s.funcs.Keys == nil {
+		return &ErrCannotListKeys{}
+	}
+	keys, err := s.funcs.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	skipped := &ErrSkippedKeys{}
+	for _, key := range keys {
+		if !inRange(key, from, to) {
+			continue
+		}
+		value, err := s.funcs.Get(key)
+		if err != nil {
+			skipped.skip(key, err)
+			continue
+		}
+		if len(value) == 0 {
+			continue
+		}
+		if !f(key, value) {
+			break
+		}
+	}
+	return skipped.result()
+}
+
+func (s *funcStorage) Batch(writes map[string][]byte) error {
+	for key, value := range writes {
+		if err := s.funcs.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *funcStorage) Sync() error {
+	return nil
+}
+
+func (s *funcStorage) Close() error {
+	return nil
+}
+
+// Durable storage on disk, with one file per key that holds JSON. File names are the key in hex,
+// which any file system can hold, so keys can be at most MaxKeySize bytes long. Each put writes a
+// temp file, syncs it and renames it over the old one, so a crash leaves either the old value or
+// the new one. A batch goes to a journal first, which is written again after a crash. Reading a file
+// that is empty or not JSON fails with ErrCorruptStorage. A dir from before keys were strings gets
+// its files renamed the first time it is opened.
+func DiskStorage(dir string) Storage {
+	return &diskStorage{dir: dir}
+}
+
+// Name of the journal in a storage dir, which is no key's file name since those end in .json
+const diskJournal = "batch"
+
+// Suffix of a file that is not in place yet, which a crash can leave behind
+const diskTemp = ".tmp"
+
+// Name of a file in every storage dir whose file names are keys in hex. A dir without one is from
+// before keys were strings, when each file was named after a uint64 key in decimal.
+const diskHexNames = "hex"
+
+type diskStorage struct {
+	dir       string
+	recovered bool // Whether a journal and temp files left by a crash were dealt with
+}
+
+func (s *diskStorage) fname(key string) string {
+	return path.Join(s.dir, hex.EncodeToString([]byte(key))+".json")
+}
+
+// Finish any batch a crash interrupted and remove temp files, before anything is read or written
+func (s *diskStorage) recover() error {
+	if s.recovered {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		s.recovered = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hexNames := false
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), diskTemp) {
+			if err := os.Remove(path.Join(s.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+		if info.Name() == diskHexNames {
+			hexNames = true
+		}
+	}
+	if !hexNames {
+		if err := s.migrate(infos); err != nil {
+			return err
+		}
+	}
+	journalBytes, err := ioutil.ReadFile(path.Join(s.dir, diskJournal))
+	if os.IsNotExist(err) {
+		s.recovered = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	journal := map[string][]byte{} // {hex key: value}
+	if err := json.Unmarshal(journalBytes, &journal); err != nil {
+		return &ErrCorruptStorage{Path: path.Join(s.dir, diskJournal)}
+	}
+	writes := map[string][]byte{}
+	for hexKey, value := range journal {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return &ErrCorruptStorage{Path: path.Join(s.dir, diskJournal)}
+		}
+		writes[string(key)] = value
+	}
+	s.recovered = true
+	if err := s.apply(writes); err != nil {
+		return err
+	}
+	return s.removeJournal()
+}
+
+// Rename the files of a dir from before keys were strings after their keys in hex. Every value goes
+// in the journal first, since a new name can be an old one too, then the old files are removed and
+// the journal is finished like any other.
+func (s *diskStorage) migrate(infos []os.FileInfo) error {
+	_, err := os.Stat(path.Join(s.dir, diskJournal))
+	if os.IsNotExist(err) {
+		writes := map[string][]byte{}
+		for _, info := range infos {
+			if !strings.HasSuffix(info.Name(), ".json") {
+				continue
+			}
+			fname := path.Join(s.dir, info.Name())
+			n, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
 			if err != nil {
+				return &ErrCorruptStorage{Path: fname}
+			}
+			value, err := s.read(fname)
+			if err != nil {
+				return err
+			}
+			key := oldKey(n)
+			if key == metaKey {
+				if value, err = migrateMeta(value); err != nil {
+					return &ErrCorruptStorage{Path: fname}
+				}
+			}
+			writes[key] = value
+		}
+		if 0 < len(writes) {
+			if err := s.writeJournal(writes); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	// A journal here can only be from a migration a crash interrupted, which wrote every value
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			if err := os.Remove(path.Join(s.dir, info.Name())); err != nil && !os.IsNotExist(err) {
 				return err
 			}
-			return ioutil.WriteFile(fname(key), value, 0600)
-		},
+		}
 	}
+	return writeFileAtomic(path.Join(s.dir, diskHexNames), []byte{})
 }
 
-// Non durable storage, only use for toy problems
-func MemoryStorage() *Storage {
-	m := map[uint64][]byte{}
-	return &Storage{
-		Get: func(key uint64) ([]byte, error) {
-			return m[key], nil
-		},
-		Put: func(key uint64, value []byte) error {
-			m[key] = value
+// The key that a uint64 key from before keys were strings is now. The top 2^32 keys were reserved,
+// the last for meta and the rest for configurations.
+func oldKey(n uint64) string {
+	const firstReserved = math.MaxUint64 - 1<<32 + 1
+	switch {
+	case n == math.MaxUint64:
+		return metaKey
+	case firstReserved <= n:
+		return configKey(n - firstReserved + 1)
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// Meta from before keys were strings, with its accepted keys renamed
+func migrateMeta(value []byte) ([]byte, error) {
+	meta := &metaStruct{}
+	if err := json.Unmarshal(value, meta); err != nil {
+		return nil, err
+	}
+	accepted := map[string]bool{}
+	for key := range meta.Accepted {
+		n, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		accepted[oldKey(n)] = true
+	}
+	meta.Accepted = accepted
+	return json.Marshal(meta)
+}
+
+// Make the dir if it is not there yet, marked as naming files in hex
+func (s *diskStorage) mkdir() error {
+	if _, err := os.Stat(s.dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(s.dir, diskHexNames), []byte{})
+}
+
+func (s *diskStorage) Get(key string) ([]byte, error) {
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	value, err := s.read(s.fname(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Read a file that should hold JSON. An empty file is corrupt too, since no JSON is empty.
+func (s *diskStorage) read(fname string) ([]byte, error) {
+	value, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(value) {
+		return nil, &ErrCorruptStorage{Path: fname}
+	}
+	return value, nil
+}
+
+func (s *diskStorage) Put(key string, value []byte) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+	return s.put(key, value)
+}
+
+func (s *diskStorage) put(key string, value []byte) error {
+	if MaxKeySize < len(key) {
+		return &ErrKeyTooLong{Key: key}
+	}
+	if err := s.mkdir(); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.fname(key), value)
+}
+
+func (s *diskStorage) Delete(key string) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+	return s.delete(key)
+}
+
+func (s *diskStorage) delete(key string) error {
+	err := os.Remove(s.fname(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func (s *diskStorage) Iterate(from, to string, f func(key string, value []byte) bool) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+	// Hex keeps the order of bytes, so the dir lists keys in order
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	skipped := &ErrSkippedKeys{}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		keyBytes, err := hex.DecodeString(strings.TrimSuffix(name, ".json"))
+		if err != nil || !inRange(string(keyBytes), from, to) {
+			continue
+		}
+		value, err := s.read(path.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// One bad file should not keep every other key from anti-entropy, scans and new members
+			skipped.skip(string(keyBytes), err)
+			continue
+		}
+		if !f(string(keyBytes), value) {
+			break
+		}
+	}
+	return skipped.result()
+}
+
+func (s *diskStorage) Batch(writes map[string][]byte) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+	if len(writes) <= 1 {
+		// A single write is all or nothing already
+		return s.apply(writes)
+	}
+	if err := s.mkdir(); err != nil {
+		return err
+	}
+	if err := s.writeJournal(writes); err != nil {
+		return err
+	}
+	if err := s.apply(writes); err != nil {
+		return err
+	}
+	return s.removeJournal()
+}
+
+func (s *diskStorage) writeJournal(writes map[string][]byte) error {
+	journal := map[string][]byte{} // {hex key: value}
+	for key, value := range writes {
+		journal[hex.EncodeToString([]byte(key))] = value
+	}
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(s.dir, diskJournal), journalBytes)
+}
+
+// Write a batch, which is durable once each write returns, so the journal can go
+func (s *diskStorage) apply(writes map[string][]byte) error {
+	for key, value := range writes {
+		err := error(nil)
+		if value == nil {
+			err = s.delete(key)
+		} else {
+			err = s.put(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diskStorage) removeJournal() error {
+	if err := os.Remove(path.Join(s.dir, diskJournal)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Every write is durable by the time it returns
+func (s *diskStorage) Sync() error {
+	return nil
+}
+
+func (s *diskStorage) Close() error {
+	return nil
+}
+
+// Write a temp file, sync it, then rename it into place and sync the dir, so the file holds either
+// what it held before or all of data, even after a crash
+func writeFileAtomic(fname string, data []byte) error {
+	temp := fname + diskTemp
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(temp, fname)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return syncDir(path.Dir(fname))
+}
+
+// Make the names of files in a dir durable, which syncing the files themselves does not
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Non durable storage, only use for toy problems. It keeps its values after closing, so a node
+// can start again on it.
+func MemoryStorage() Storage {
+	return memoryStorage{}
+}
+
+type memoryStorage map[string][]byte // {key: value}
+
+func (m memoryStorage) Get(key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func (m memoryStorage) Put(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryStorage) Delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func (m memoryStorage) Iterate(from, to string, f func(key string, value []byte) bool) error {
+	keys := []string{}
+	for key := range m {
+		if inRange(key, from, to) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !f(key, m[key]) {
 			return nil
-		},
+		}
+	}
+	return nil
+}
+
+func (m memoryStorage) Batch(writes map[string][]byte) error {
+	for key, value := range writes {
+		if value == nil {
+			delete(m, key)
+		} else {
+			m[key] = value
+		}
 	}
+	return nil
+}
+
+func (m memoryStorage) Sync() error {
+	return nil
+}
+
+func (m memoryStorage) Close() error {
+	return nil
 }
 
 type stateStruct struct {
-	N         uint64 `json:"n"`
-	PromisedN uint64 `json:"promisedN"`
-	AcceptedN uint64 `json:"acceptedN"`
+	N         uint64 `json:"n"` // Highest round this node has proposed with
+	PromisedN ballot `json:"promisedN"`
+	AcceptedN ballot `json:"acceptedN"`
 	Value     []byte `json:"value"`
+	Hash      string `json:"hash,omitempty"` // Of the value, which a witness keeps instead
 	Final     bool   `json:"final"`
 }
+
+// State that belongs to the node rather than any one key
+type metaStruct struct {
+	N         uint64          `json:"n"`         // Highest round this node has campaigned with
+	PromisedN ballot          `json:"promisedN"` // Promise to a leader, covers every key
+	Accepted  map[string]bool `json:"accepted"`  // Keys with an accepted value that is not final, or any if storage cannot list keys
+	Epoch     uint64          `json:"epoch"`     // Highest configuration epoch seen
+
+	// Helped a round other than the leader's, so grant no leases until promising the next leader
+	LeaseBlocked bool `json:"leaseBlocked"`
+}
+
+// Meta in JSON, where accepted keys that are not UTF-8 go in a list of their own, since JSON object
+// keys are strings
+type metaJSON struct {
+	*plainMeta
+	AcceptedBytes [][]byte `json:"acceptedBytes,omitempty"`
+}
+
+// Meta without its own JSON methods
+type plainMeta metaStruct
+
+func (meta *metaStruct) MarshalJSON() ([]byte, error) {
+	metaJSON := &metaJSON{plainMeta: (*plainMeta)(meta)}
+	for key := range meta.Accepted {
+		if !utf8.ValidString(key) {
+			metaJSON.AcceptedBytes = append(metaJSON.AcceptedBytes, []byte(key))
+		}
+	}
+	if 0 < len(metaJSON.AcceptedBytes) {
+		// A copy of meta with only the UTF-8 keys in the object
+		meta2 := *meta
+		meta2.Accepted = map[string]bool{}
+		for key, accepted := range meta.Accepted {
+			if utf8.ValidString(key) {
+				meta2.Accepted[key] = accepted
+			}
+		}
+		metaJSON.plainMeta = (*plainMeta)(&meta2)
+	}
+	return json.Marshal(metaJSON)
+}
+
+func (meta *metaStruct) UnmarshalJSON(data []byte) error {
+	metaJSON := &metaJSON{plainMeta: (*plainMeta)(meta)}
+	if err := json.Unmarshal(data, metaJSON); err != nil {
+		return err
+	}
+	for _, key := range metaJSON.AcceptedBytes {
+		if meta.Accepted == nil {
+			meta.Accepted = map[string]bool{}
+		}
+		meta.Accepted[string(key)] = true
+	}
+	return nil
+}
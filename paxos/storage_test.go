@@ -0,0 +1,365 @@
+package paxos
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Storage made of funcs over a map, the way storage used to be written
+func mapStorage() Storage {
+	m := map[string][]byte{}
+	return FuncStorage(&StorageFuncs{
+		Get: func(key string) ([]byte, error) {
+			return m[key], nil
+		},
+		Put: func(key string, value []byte) error {
+			m[key] = value
+			return nil
+		},
+		Keys: func() ([]string, error) {
+			keys := []string{}
+			for key := range m {
+				keys = append(keys, key)
+			}
+			return keys, nil
+		},
+	})
+}
+
+// Storage that records which keys each write touched
+type recordingStorage struct {
+	Storage
+	mutex   sync.Mutex
+	puts    []string
+	batches [][]string
+}
+
+func (s *recordingStorage) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	s.puts = append(s.puts, key)
+	s.mutex.Unlock()
+	return s.Storage.Put(key, value)
+}
+
+func (s *recordingStorage) Batch(writes map[string][]byte) error {
+	keys := []string{}
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	s.mutex.Lock()
+	s.batches = append(s.batches, keys)
+	s.mutex.Unlock()
+	return s.Storage.Batch(writes)
+}
+
+func TestStateInOneBatch(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetMultiPaxos(true)
+	storages := []*recordingStorage{}
+	nodes := []*Node{}
+	for i := 0; i < 3; i++ {
+		storage := &recordingStorage{Storage: MemoryStorage()}
+		storages = append(storages, storage)
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i), storage))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := nodes[0].Write(ctx, "k1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepting a value saves it along with meta listing the key as accepted
+	together := false
+	for _, storage := range storages {
+		storage.mutex.Lock()
+		if 0 < len(storage.puts) {
+			t.Errorf("state written outside a batch: %v", storage.puts)
+		}
+		for _, keys := range storage.batches {
+			sort.Strings(keys)
+			if reflect.DeepEqual(keys, []string{metaKey, "k1"}) {
+				together = true
+			}
+		}
+		storage.mutex.Unlock()
+	}
+	if !together {
+		t.Error("no batch wrote k1 along with meta")
+	}
+}
+
+func TestStorages(t *testing.T) {
+	storages := map[string]func(t *testing.T) Storage{ // {name: new storage}
+		"memory": func(t *testing.T) Storage { return MemoryStorage() },
+		"disk":   func(t *testing.T) Storage { return DiskStorage(t.TempDir()) },
+		"funcs":  func(t *testing.T) Storage { return mapStorage() },
+		"log": func(t *testing.T) Storage {
+			s, err := LogStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage(t)
+			defer s.Close()
+			if value, err := s.Get("a"); value != nil || err != nil {
+				t.Fatalf("got %q, %v for a missing key", value, err)
+			}
+			for _, key := range []string{"a", "b", "c", "d"} {
+				if err := s.Put(key, []byte(`"`+key+`"`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Batch(map[string][]byte{"c": nil, "d": []byte(`"d2"`), "e": []byte(`"e"`)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := s.Get("b"); value != nil || err != nil {
+				t.Fatalf("got %q, %v for a deleted key", value, err)
+			}
+			want := map[string]string{"a": `"a"`, "d": `"d2"`, "e": `"e"`}
+			if got := iterate(t, s, "", ""); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			want = map[string]string{"d": `"d2"`}
+			if got := iterate(t, s, "b", "e"); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+
+			// In byte order, until told to stop
+			keys := []string{}
+			err := s.Iterate("", "", func(key string, value []byte) bool {
+				keys = append(keys, key)
+				return len(keys) < 2
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "d"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("iterated %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+// Every key and value in a range of storage, failing on any error
+func iterate(t *testing.T, s Storage, from, to string) map[string]string {
+	got := map[string]string{}
+	err := s.Iterate(from, to, func(key string, value []byte) bool {
+		got[key] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// Meta keeps the keys it accepted whole, even ones that JSON strings cannot hold
+func TestMetaKeys(t *testing.T) {
+	for _, accepted := range []map[string]bool{nil, {"a": true}, {"a": true, "\xff\x01": true}} {
+		want := &metaStruct{N: 3, Accepted: accepted, Epoch: 2}
+		data, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &metaStruct{}
+		if err := json.Unmarshal(data, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+// A crash in the middle of a batch leaves the journal, which the next operation writes again
+func TestDiskStorageJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		want    map[string]string // Nil if the journal is corrupt
+	}{
+		{"puts", journalOf(t, map[string][]byte{"a": []byte(`"a2"`), "c": []byte(`"c"`)}), map[string]string{"a": `"a2"`, "b": `"b"`, "c": `"c"`}},
+		{"deletes", journalOf(t, map[string][]byte{"a": nil, "b": []byte(`"b2"`)}), map[string]string{"b": `"b2"`}},
+		// The journal is renamed into place whole, so only a bad disk tears it
+		{"torn", `{"61":`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := DiskStorage(dir)
+			if err := s.Batch(map[string][]byte{"a": []byte(`"a"`), "b": []byte(`"b"`)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, diskJournal), []byte(test.journal), 0600); err != nil {
+				t.Fatal(err)
+			}
+			// A put the crash cut short
+			if err := ioutil.WriteFile(s.(*diskStorage).fname("a")+diskTemp, []byte(`"half`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s = DiskStorage(dir)
+			if test.want == nil {
+				if _, err := s.Get("a"); err == nil {
+					t.Fatal("read past a corrupt journal")
+				} else if _, ok := err.(*ErrCorruptStorage); !ok {
+					t.Fatalf("got %v, want ErrCorruptStorage", err)
+				}
+				return
+			}
+			if got := iterate(t, s, "", ""); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != len(test.want)+1 {
+				t.Fatalf("got %d files, want %d and the hex marker, without the journal and temp file", len(infos), len(test.want))
+			}
+		})
+	}
+}
+
+// A dir from before keys were strings, with each file named after a uint64 key in decimal
+func TestDiskStorageMigrate(t *testing.T) {
+	meta := `{"n":0,"promisedN":{"round":0,"nodeId":""},"accepted":{"31":true,"18446744069414584320":true},"epoch":1,"leaseBlocked":false}`
+	old := map[string]string{
+		"1.json":                    `"one"`,
+		"31.json":                   `"thirty one"`, // The new name of key 1
+		"18446744069414584320.json": `"config"`,     // First reserved key
+		"18446744073709551615.json": meta,           // MaxUint64
+	}
+	want := map[string]string{
+		"1":          `"one"`,
+		"31":         `"thirty one"`,
+		configKey(1): `"config"`,
+		metaKey:      `{"n":0,"promisedN":{"round":0,"nodeId":""},"accepted":{"\u0000config/00000000000000000001":true,"31":true},"epoch":1,"leaseBlocked":false}`,
+	}
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]string // Nil if the dir is corrupt
+	}{
+		{"old", old, want},
+		// A crash after the journal, with key 1 already in its new file and the old ones gone
+		{"interrupted", map[string]string{
+			diskJournal: journalOf(t, map[string][]byte{"1": []byte(`"one"`), "31": []byte(`"thirty one"`)}),
+			"31.json":   `"one"`,
+		}, map[string]string{"1": `"one"`, "31": `"thirty one"`}},
+		{"not a key", map[string]string{"1.json": `"one"`, "x.json": `"x"`}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range test.files {
+				if err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := DiskStorage(dir)
+			if test.want == nil {
+				if _, err := s.Get("1"); err == nil {
+					t.Fatal("read from a dir with a file that is no key")
+				} else if _, ok := err.(*ErrCorruptStorage); !ok {
+					t.Fatalf("got %v, want ErrCorruptStorage", err)
+				}
+				return
+			}
+			if got := iterate(t, s, "", ""); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			// Opening it again leaves it be, even though new names can look like old ones
+			if got := iterate(t, DiskStorage(dir), "", ""); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v after opening again, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiskStorageCorrupt(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		corrupt  bool
+	}{
+		{"empty", "", true},
+		{"truncated", `{"value":`, true},
+		{"not json", "\x00\x01", true},
+		{"json", `{"value":"eA=="}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := DiskStorage(t.TempDir())
+			for _, key := range []string{"a", "b", "c"} {
+				if err := s.Put(key, []byte(`"`+key+`"`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(s.(*diskStorage).fname("b"), []byte(test.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.Get("b")
+			if _, ok := err.(*ErrCorruptStorage); ok != test.corrupt {
+				t.Fatalf("got %v reading b", err)
+			}
+			got := []string{}
+			err = s.Iterate("", "", func(key string, value []byte) bool {
+				got = append(got, key)
+				return true
+			})
+			if !test.corrupt {
+				if err != nil || len(got) != 3 {
+					t.Fatalf("got %v, %v", got, err)
+				}
+				return
+			}
+			// The other keys are still there, and the skipped one is reported after
+			if !reflect.DeepEqual(got, []string{"a", "c"}) {
+				t.Fatalf("got %v", got)
+			}
+			skipped, ok := err.(*ErrSkippedKeys)
+			if !ok || !reflect.DeepEqual(skipped.Keys, []string{"b"}) {
+				t.Fatalf("got %v, want b skipped", err)
+			}
+			if _, ok := skipped.Errs[0].(*ErrCorruptStorage); !ok {
+				t.Fatalf("got %v, want ErrCorruptStorage", skipped.Errs[0])
+			}
+		})
+	}
+}
+
+// The journal a batch writes before it writes any of the batch
+func journalOf(t *testing.T, writes map[string][]byte) string {
+	journal := map[string][]byte{} // {hex key: value}
+	for key, value := range writes {
+		journal[hex.EncodeToString([]byte(key))] = value
+	}
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(journalBytes)
+}
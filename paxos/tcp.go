@@ -0,0 +1,268 @@
+package paxos
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpQueueSize    = 1024    // Messages waiting to go out to each node, past which Send fails
+	tcpMaxFrameSize = 1 << 26 // Longest message a node reads, so a bad length cannot use up memory
+	tcpMinBackoff   = 50 * time.Millisecond
+	tcpMaxBackoff   = 5 * time.Second
+)
+
+// The state behind a TCP transport
+type tcpTransport struct {
+	listener net.Listener
+	addr     func(id string) string
+	ctx      context.Context // Done once the transport closes
+	cancel   context.CancelFunc
+	group    sync.WaitGroup
+
+	mutex     sync.Mutex
+	closed    bool
+	peers     map[string]chan []byte                                 // {id: queue} of messages to send
+	receivers map[string]func(ctx context.Context, msg []byte) error // {id: receive} local nodes
+	conns     map[net.Conn]struct{}                                  // {conn: null} open in either direction
+}
+
+// Sends messages over one long lived TCP connection to each node, and listens on addr for the
+// connections of other nodes. The nodeAddr func gives the address of a node from its id, or ids are
+// the addresses if it is nil. Each message goes out with its length in front of it. A connection
+// that breaks is dialed again after waiting longer each time, up to a few seconds, while up to 1024
+// messages wait for it. Messages for local nodes never touch the network.
+func TCPTransport(addr string, nodeAddr func(id string) string) (Transport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if nodeAddr == nil {
+		nodeAddr = func(id string) string { return id }
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &tcpTransport{
+		listener:  listener,
+		addr:      nodeAddr,
+		ctx:       ctx,
+		cancel:    cancel,
+		peers:     map[string]chan []byte{},
+		receivers: map[string]func(ctx context.Context, msg []byte) error{},
+		conns:     map[net.Conn]struct{}{},
+	}
+	t.group.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+func (t *tcpTransport) Send(ctx context.Context, id string, msg []byte) error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return &ErrClosed{}
+	}
+	if receive, ok := t.receivers[id]; ok {
+		t.mutex.Unlock()
+		return receive(ctx, msg)
+	}
+	queue, ok := t.peers[id]
+	if !ok {
+		queue = make(chan []byte, tcpQueueSize)
+		t.peers[id] = queue
+		t.group.Add(1)
+		go t.write(id, queue)
+	}
+	t.mutex.Unlock()
+	select {
+	case queue <- msg:
+		return nil
+	default:
+		return &ErrQueueFull{ID: id}
+	}
+}
+
+func (t *tcpTransport) Listen(id string, receive func(ctx context.Context, msg []byte) error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if receive == nil {
+		delete(t.receivers, id)
+	} else {
+		t.receivers[id] = receive
+	}
+}
+
+// Stop listening, close every connection and wait for every goroutine to exit
+func (t *tcpTransport) Close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.cancel()
+	err := t.listener.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+	t.group.Wait()
+	return err
+}
+
+// Remember a connection so Close can close it. Returns false if the transport already closed.
+func (t *tcpTransport) track(conn net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tcpTransport) untrack(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.conns, conn)
+	conn.Close()
+}
+
+func (t *tcpTransport) accept() {
+	defer t.group.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return
+			}
+			// Most likely out of file descriptors, which may pass
+			select {
+			case <-time.After(tcpMinBackoff):
+				continue
+			case <-t.ctx.Done():
+				return
+			}
+		}
+		if !t.track(conn) {
+			conn.Close()
+			return
+		}
+		t.group.Add(1)
+		go t.read(conn)
+	}
+}
+
+// Hand every message on a connection to the local node it is for, which the first frame names
+func (t *tcpTransport) read(conn net.Conn) {
+	defer t.group.Done()
+	defer t.untrack(conn)
+	reader := bufio.NewReader(conn)
+	id, err := readFrame(reader)
+	if err != nil {
+		return
+	}
+	for {
+		msg, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		t.mutex.Lock()
+		receive := t.receivers[string(id)]
+		t.mutex.Unlock()
+		if receive != nil {
+			// A message the node does not take is lost like any other, and sent again if it matters
+			receive(t.ctx, msg)
+		}
+	}
+}
+
+// Keep a connection open to a node and send it everything in its queue
+func (t *tcpTransport) write(id string, queue <-chan []byte) {
+	defer t.group.Done()
+	dialer := &net.Dialer{}
+	backoff := tcpMinBackoff
+	for {
+		conn, err := dialer.DialContext(t.ctx, "tcp", t.addr(id))
+		if err == nil && !t.track(conn) {
+			conn.Close()
+			return
+		}
+		if err == nil {
+			backoff = tcpMinBackoff
+			t.pump(conn, id, queue)
+			t.untrack(conn)
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-t.ctx.Done():
+			return
+		}
+		if backoff *= 2; tcpMaxBackoff < backoff {
+			backoff = tcpMaxBackoff
+		}
+	}
+}
+
+// Send the queue over a connection until it breaks
+func (t *tcpTransport) pump(conn net.Conn, id string, queue <-chan []byte) {
+	// Nothing comes back, so reading only finds out when the other side hangs up
+	t.group.Add(1)
+	go func() {
+		defer t.group.Done()
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+	writer := bufio.NewWriter(conn)
+	if writeFrame(writer, []byte(id)) != nil {
+		return
+	}
+	for {
+		if len(queue) == 0 {
+			// Nothing else is waiting, so send everything so far before waiting on the next one
+			if writer.Flush() != nil {
+				return
+			}
+		}
+		select {
+		case msg := <-queue:
+			if writeFrame(writer, msg) != nil {
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func writeFrame(writer *bufio.Writer, frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := writer.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(frame)
+	return err
+}
+
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if tcpMaxFrameSize < size {
+		return nil, &ErrInvalidMessage{}
+	}
+	frame := make([]byte, size)
+	_, err := io.ReadFull(reader, frame)
+	return frame, err
+}
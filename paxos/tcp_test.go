@@ -0,0 +1,123 @@
+package paxos
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Addresses on the loopback that nothing listens on
+func freeAddrs(t *testing.T, n int) []string {
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		addrs = append(addrs, listener.Addr().String())
+	}
+	return addrs
+}
+
+// A network of its own for one node, as if it were in a process of its own, where each id is the
+// address the node listens on
+func newTCPNetwork(t *testing.T, addrs []string, i int, storage Storage) (*Network, *Node) {
+	transport, err := TCPTransport(addrs[i], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewNetwork()
+	network.SetTransport(transport)
+	for j, addr := range addrs {
+		if j != i {
+			network.AddRemoteNode(addr)
+		}
+	}
+	return network, network.AddNode(addrs[i], storage)
+}
+
+func TestTCPTransport(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	addrs := freeAddrs(t, 3)
+	networks, nodes, storages := []*Network{}, []*Node{}, []Storage{}
+	for i := range addrs {
+		storages = append(storages, MemoryStorage())
+		network, node := newTCPNetwork(t, addrs, i, storages[i])
+		networks, nodes = append(networks, network), append(nodes, node)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	write := func(node *Node, keys ...string) {
+		for _, key := range keys {
+			if value, err := node.Write(ctx, key, []byte(key)); err != nil || string(value) != key {
+				t.Fatalf("wrote %q, %v for %s", value, err, key)
+			}
+		}
+	}
+	write(nodes[0], "a", "b")
+	write(nodes[1], "c")
+
+	// A node that goes away and comes back on the same address is dialed again
+	if err := networks[2].Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	write(nodes[0], "d")
+	networks[2], nodes[2] = newTCPNetwork(t, addrs, 2, storages[2])
+	write(nodes[2], "e")
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		checkAgreement(ctx, t, nodes, key, map[string]bool{key: true})
+	}
+
+	// Closing every network closes every connection, and no goroutine outlives them
+	for _, network := range networks {
+		if err := network.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for goroutines < runtime.NumGoroutine() {
+		select {
+		case <-ctx.Done():
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines before, %d after closing\n%s", goroutines, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := bufio.NewWriter(buf)
+	frames := [][]byte{[]byte("n0"), {}, bytes.Repeat([]byte("x"), 1<<16)}
+	for _, frame := range frames {
+		if err := writeFrame(writer, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(buf)
+	for _, want := range frames {
+		frame, err := readFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("read a frame of %d bytes, want %d", len(frame), len(want))
+		}
+	}
+
+	// A length past the limit is refused rather than allocated
+	_, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0})))
+	if _, ok := err.(*ErrInvalidMessage); !ok {
+		t.Fatalf("got %v, want ErrInvalidMessage", err)
+	}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 5, 'a'}))); err == nil {
+		t.Fatal("read a frame cut short")
+	}
+}
@@ -0,0 +1,91 @@
+package paxos
+
+import (
+	"context"
+	"sync"
+)
+
+// Transport carries encoded messages between nodes. Like Storage and Codec, you can bring your own
+// to reach nodes in other processes.
+type Transport interface {
+	// Deliver a message to a node, giving up once ctx is done. Requests that get lost are sent
+	// again, so there is no need to retry. Errors are logged.
+	Send(ctx context.Context, id string, msg []byte) error
+	// Hand every message sent to a local node to receive, or stop once receive is nil. An error from
+	// receive means the node did not take the message, such as when the node is closed, which a
+	// transport can pass back to the sender.
+	Listen(id string, receive func(ctx context.Context, msg []byte) error)
+	Close() error // Called once the network closes
+}
+
+// A transport made of funcs, which FuncTransport adapts
+type TransportFuncs struct {
+	Send   func(ctx context.Context, id string, msg []byte) error
+	Listen func(id string, receive func(ctx context.Context, msg []byte) error)
+	Close  func() error // Optional
+}
+
+// Transport made of funcs
+func FuncTransport(funcs *TransportFuncs) Transport {
+	return &funcTransport{funcs}
+}
+
+type funcTransport struct {
+	funcs *TransportFuncs
+}
+
+func (t *funcTransport) Send(ctx context.Context, id string, msg []byte) error {
+	return t.funcs.Send(ctx, id, msg)
+}
+
+func (t *funcTransport) Listen(id string, receive func(ctx context.Context, msg []byte) error) {
+	t.funcs.Listen(id, receive)
+}
+
+func (t *funcTransport) Close() error {
+	if t.funcs.Close == nil {
+		return nil
+	}
+	return t.funcs.Close()
+}
+
+// Delivers messages between nodes in the same process. Every network has its own unless told
+// otherwise, and networks that share one reach each other's nodes like separate processes would.
+func MemoryTransport() Transport {
+	return &memoryTransport{receivers: map[string]func(ctx context.Context, msg []byte) error{}}
+}
+
+type memoryTransport struct {
+	mutex     sync.Mutex
+	receivers map[string]func(ctx context.Context, msg []byte) error // {id: receive}
+}
+
+func (t *memoryTransport) Send(ctx context.Context, id string, msg []byte) error {
+	t.mutex.Lock()
+	receive, ok := t.receivers[id]
+	t.mutex.Unlock()
+	if !ok {
+		return &ErrUnreachable{ID: id}
+	}
+	return receive(ctx, msg)
+}
+
+func (t *memoryTransport) Listen(id string, receive func(ctx context.Context, msg []byte) error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if receive == nil {
+		delete(t.receivers, id)
+	} else {
+		t.receivers[id] = receive
+	}
+}
+
+// Nothing to close, since other networks may still share it
+func (t *memoryTransport) Close() error {
+	return nil
+}
+
+// Set how nodes reach each other. It must be set before any nodes are added.
+func (network *Network) SetTransport(transport Transport) {
+	network.transport = transport
+}
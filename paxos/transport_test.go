@@ -0,0 +1,64 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Networks that share a transport reach each other's nodes, like processes on different machines
+func TestSharedTransport(t *testing.T) {
+	transport := MemoryTransport()
+	networks, nodes := []*Network{}, []*Node{}
+	for i := 0; i < 3; i++ {
+		network := NewNetwork()
+		defer network.Close(context.Background())
+		network.SetTransport(transport)
+		for j := 0; j < 3; j++ {
+			if j != i {
+				network.AddRemoteNode(fmt.Sprintf("n%d", j))
+			}
+		}
+		networks = append(networks, network)
+	}
+	for i, network := range networks {
+		nodes = append(nodes, network.AddNode(fmt.Sprintf("n%d", i), MemoryStorage()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for k := 0; k < 5; k++ {
+		if _, err := nodes[k%3].Write(ctx, fmt.Sprint("k", k), []byte(fmt.Sprint("value", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := 0; k < 5; k++ {
+		checkAgreement(ctx, t, nodes, fmt.Sprint("k", k), map[string]bool{fmt.Sprint("value", k): true})
+	}
+
+	// A node in another process going away leaves a quorum behind
+	if err := networks[2].Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].Write(ctx, "after", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A node reaches itself even when the transport reaches nobody
+func TestTransportSkipsSelf(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetTransport(FuncTransport(&TransportFuncs{
+		Send: func(ctx context.Context, id string, msg []byte) error {
+			return &ErrUnreachable{ID: id}
+		},
+		Listen: func(id string, receive func(ctx context.Context, msg []byte) error) {},
+	}))
+	node := network.AddNode("n0", MemoryStorage())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if value, err := node.Write(ctx, "k", []byte("x")); err != nil || string(value) != "x" {
+		t.Fatalf("wrote %q, %v", value, err)
+	}
+}
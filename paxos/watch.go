@@ -0,0 +1,126 @@
+package paxos
+
+import (
+	"context"
+)
+
+// Someone waiting to hear about keys in a range becoming final on this node
+type watchStruct struct {
+	opID    string
+	ctx     context.Context
+	from    string
+	to      string // Empty for no end
+	current bool   // Whether to send the key's value if it is final already, for a single key
+	in      chan<- *KeyValue
+}
+
+// Wait for a key to be final on this node. The channel gets the key's value, right away if it is
+// already final, and closes after it or once ctx is done or the node closes.
+func (node *Node) Watch(ctx context.Context, key string) <-chan []byte {
+	out := make(chan []byte, 1)
+	if checkKey(key) != nil {
+		close(out)
+		return out
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	started := node.life.goroutine(func() {
+		defer close(out)
+		defer cancel() // Only one value is coming
+		// Adding a zero byte gives the next key after it, so the range holds only this key
+		keyValue, ok := <-node.watch(ctx, key, key+"\x00", true)
+		if ok {
+			out <- keyValue.Value
+		}
+	})
+	if !started {
+		cancel()
+		close(out)
+	}
+	return out
+}
+
+// Hear about every key from from up to but not including to as it becomes final on this node, where
+// an empty to has no end. Keys that were final before the call are left out, so use Scan for those.
+// The channel closes once ctx is done or the node closes.
+func (node *Node) WatchRange(ctx context.Context, from, to string) <-chan *KeyValue {
+	return node.watch(ctx, from, to, false)
+}
+
+func (node *Node) watch(ctx context.Context, from, to string, current bool) <-chan *KeyValue {
+	in, out := make(chan *KeyValue), make(chan *KeyValue)
+	watch := &watchStruct{
+		opID:    newOpID(),
+		ctx:     ctx,
+		from:    from,
+		to:      to,
+		current: current,
+		in:      in,
+	}
+	started := node.life.goroutine(func() {
+		defer close(out)
+		select {
+		case node.watchChan <- watch:
+		case <-ctx.Done():
+			return
+		case <-node.life.done:
+			return
+		}
+		// Keep everything the node sends until the caller takes it, so the node never waits
+		queue := []*KeyValue{}
+		for {
+			send, next := (chan<- *KeyValue)(nil), (*KeyValue)(nil)
+			if 0 < len(queue) {
+				send, next = out, queue[0]
+			}
+			select {
+			case keyValue := <-in:
+				queue = append(queue, keyValue)
+			case send <- next:
+				queue = queue[1:]
+			case <-ctx.Done():
+				node.clean(watch.opID)
+				return
+			case <-node.life.done:
+				return
+			}
+		}
+	})
+	if !started {
+		close(out)
+	}
+	return out
+}
+
+func (loop *nodeLoop) startWatch(watch *watchStruct) {
+	loop.watchMap[watch.opID] = watch
+	if !watch.current {
+		return
+	}
+	// The key may have been final before anyone watched it
+	state, err := loop.getState(watch.from)
+	if err != nil {
+		loop.network.stderrLogger.Print(err)
+		return
+	}
+	if state.Final && state.Hash == "" {
+		loop.notify(watch, watch.from, state.Value)
+	}
+}
+
+// A key just became final on this node
+func (loop *nodeLoop) learned(key string, value []byte) {
+	loop.finishReads(key, value)
+	for _, watch := range loop.watchMap {
+		if !isReserved(key) && inRange(key, watch.from, watch.to) {
+			loop.notify(watch, key, value)
+		}
+	}
+}
+
+func (loop *nodeLoop) notify(watch *watchStruct, key string, value []byte) {
+	select {
+	case watch.in <- &KeyValue{Key: key, Value: value}:
+	case <-watch.ctx.Done():
+	case <-loop.life.done:
+	}
+}
@@ -0,0 +1,89 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Before the key is written
+	watches := []<-chan []byte{}
+	for _, node := range nodes {
+		watches = append(watches, node.Watch(ctx, "k1"))
+	}
+	if _, err := nodes[0].Write(ctx, "k1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for i, watch := range watches {
+		if value := <-watch; string(value) != "x" {
+			t.Fatalf("n%d watched %q, want x", i, value)
+		}
+		if _, ok := <-watch; ok {
+			t.Fatalf("n%d watch did not close", i)
+		}
+	}
+
+	// After it is final
+	if value := <-nodes[0].Watch(ctx, "k1"); string(value) != "x" {
+		t.Fatalf("watched %q, want x", value)
+	}
+
+	// Until the caller gives up
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	watch := nodes[0].Watch(watchCtx, "k2")
+	watchCancel()
+	if _, ok := <-watch; ok {
+		t.Fatal("got a value for a key nobody wrote")
+	}
+	if _, ok := <-nodes[0].Watch(ctx, metaKey); ok {
+		t.Fatal("watched a reserved key")
+	}
+}
+
+func TestWatchRange(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Final on n1 before it watches
+	if _, err := nodes[1].Write(ctx, "k10", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	watch := nodes[1].WatchRange(watchCtx, "k10", "k20")
+	for k := 5; k < 25; k++ {
+		if _, err := nodes[k%3].Write(ctx, fmt.Sprint("k", k), []byte(fmt.Sprint("value", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every final value of a key in the range, and nothing else, in whatever order they came
+	got := map[string]string{}
+	for len(got) < 9 {
+		select {
+		case keyValue := <-watch:
+			if keyValue.Key < "k11" || "k20" <= keyValue.Key {
+				t.Fatalf("watched %s", keyValue.Key)
+			}
+			if string(keyValue.Value) != "value"+strings.TrimPrefix(keyValue.Key, "k") {
+				t.Fatalf("watched %q for %s", keyValue.Value, keyValue.Key)
+			}
+			got[keyValue.Key] = string(keyValue.Value)
+		case <-ctx.Done():
+			t.Fatalf("only watched %v", got)
+		}
+	}
+	watchCancel()
+	for keyValue := range watch {
+		t.Fatalf("watched %s after the final value of every key", keyValue.Key)
+	}
+}
@@ -0,0 +1,127 @@
+package paxos
+
+// A witness votes like any member, but only keeps a hash of each value so it can run on a tiny
+// machine. Other members have to supply values when only a witness knows about them, so every phase
+// 2 quorum includes at least one member that is not a witness. It must be set the same way on every
+// node, and before adding the witness itself.
+func (network *Network) SetWitness(id string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.witnesses[id] = struct{}{}
+}
+
+// Creates a local witness, a member that keeps hashes rather than values
+func (network *Network) AddWitness(id string, storage Storage) *Node {
+	network.SetWitness(id)
+	return network.AddNode(id, storage)
+}
+
+func (network *Network) isWitness(id string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	_, ok := network.witnesses[id]
+	return ok
+}
+
+// Whether ids include a member that keeps values
+func (loop *nodeLoop) hasReplica(ids map[string]struct{}) bool {
+	members := loop.members()
+	for id := range ids {
+		if _, ok := members[id]; ok && !loop.network.isWitness(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// The hash of the value a message carries, or stands in for when it comes from a witness
+func valueHash(msg *message) string {
+	if msg.Hash != "" {
+		return msg.Hash
+	}
+	return getHash(msg.Value)
+}
+
+// Asking the members that keep values for one that only a witness reported
+type fetchStruct struct {
+	key        string
+	hash       string
+	waitingMap map[string]struct{} // {sender: null}
+	done       func(value []byte)
+}
+
+// Find the value with a hash, calling done with it, or with nil once every member that keeps values
+// says it does not have it
+func (loop *nodeLoop) fetch(opID string, key string, hash string, done func(value []byte)) {
+	ids := map[string]struct{}{}
+	for id := range loop.members() {
+		if !loop.network.isWitness(id) {
+			ids[id] = struct{}{}
+		}
+	}
+	request := &message{
+		Type: valueRequestType,
+		OpID: opID,
+		Key:  key,
+		Hash: hash,
+	}
+	loop.fetchMap[opID] = &fetchStruct{
+		key:        key,
+		hash:       hash,
+		waitingMap: loop.multicast(ids, request),
+		done:       done,
+	}
+	loop.expect(request)
+}
+
+func (loop *nodeLoop) handleValueRequest(msg *message, state *stateStruct) {
+	value := []byte(nil)
+	if state.Value != nil && getHash(state.Value) == msg.Hash {
+		value = state.Value
+	}
+	loop.send(msg.Sender, &message{
+		Type:  valueResponseType,
+		OpID:  msg.OpID,
+		Key:   msg.Key,
+		Value: value,
+	})
+}
+
+func (loop *nodeLoop) handleValueResponse(msg *message) {
+	fetch, ok := loop.fetchMap[msg.OpID]
+	if !ok || fetch.key != msg.Key {
+		return
+	}
+	if _, ok := fetch.waitingMap[msg.Sender]; !ok {
+		return
+	}
+	delete(fetch.waitingMap, msg.Sender)
+	switch {
+	case msg.Value != nil && getHash(msg.Value) == fetch.hash:
+		delete(loop.fetchMap, msg.OpID)
+		fetch.done(msg.Value)
+	case len(fetch.waitingMap) == 0:
+		delete(loop.fetchMap, msg.OpID)
+		fetch.done(nil)
+	}
+}
+
+// A witness bounced a final value without the value, so get it from someone who has it
+func (loop *nodeLoop) fetchFinal(msg *message) {
+	if _, ok := loop.msgMap[msg.OpID]; !ok {
+		return // Nothing here is waiting on it
+	}
+	loop.fetch(msg.OpID, msg.Key, msg.Hash, func(value []byte) {
+		if value == nil {
+			loop.network.stderrLogger.Printf("%s cannot find the final value of key %q", loop.id, msg.Key)
+			return
+		}
+		loop.handleMessage(&message{
+			Type:   finalType,
+			Sender: msg.Sender,
+			OpID:   msg.OpID,
+			Key:    msg.Key,
+			Value:  value,
+		})
+	})
+}
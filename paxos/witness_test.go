@@ -0,0 +1,74 @@
+package paxos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWitness(t *testing.T) {
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	nodes := addTestNodes(network, 2)
+	storage := newLockedStorage()
+	nodes = append(nodes, network.AddWitness("n2", storage))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for k := 0; k < 10; k++ {
+		key, value := fmt.Sprint("k", k), []byte(fmt.Sprint("value", k))
+		if _, err := nodes[k%3].Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		// The witness reads it too, fetching it from another member
+		for i, node := range nodes {
+			got, err := node.Read(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(value) {
+				t.Fatalf("n%d read %q for %s, want %q", i, got, key, value)
+			}
+		}
+		stateBytes, err := storage.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := &stateStruct{}
+		if err := json.Unmarshal(stateBytes, state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Value != nil || state.Hash != getHash(value) {
+			t.Fatalf("witness stored value %q and hash %q for %s", state.Value, state.Hash, key)
+		}
+	}
+}
+
+// A value that only the witness and one other member accepted is still recovered by members that
+// never saw it
+func TestWitnessFetch(t *testing.T) {
+	value := []byte("x")
+	accepted := stateStruct{PromisedN: ballot{5, "a"}, AcceptedN: ballot{5, "a"}, Value: value}
+	witnessed := accepted
+	witnessed.Value, witnessed.Hash = nil, getHash(value)
+	network := NewNetwork()
+	defer network.Close(context.Background())
+	network.SetWitness("n2")
+	nodes := []*Node{
+		network.AddNode("n0", storageWith("k1", &accepted)),
+		network.AddNode("n1", storageWith("k1", &stateStruct{})),
+		network.AddNode("n2", storageWith("k1", &witnessed)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, i := range []int{2, 1, 0} {
+		got, err := nodes[i].Read(ctx, "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(value) {
+			t.Fatalf("n%d read %q, want %q", i, got, value)
+		}
+	}
+}